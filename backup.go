@@ -0,0 +1,508 @@
+/// File: backup.go
+/// Purpose: Backs up containers into a content-addressed backup store and
+/// restores them, possibly under a different name.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The format of backup identifiers, which are derived from the time the
+// backup was taken.
+const BACKUP_ID_FORMAT string = "20060102-150405"
+
+// The directories of a container, relative to its root directory, that
+// are backed up. The root filesystem is not backed up since it is an AUFS
+// mount of the image set and the private data.
+var backup_dirs = []string{"meta", "private-data"}
+
+// Matches chunk identifiers: hexadecimal SHA-256 hashes.
+var chunk_regexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Describes one file, directory, or link in a backup.
+type BackupEntry struct {
+
+	/* The pathname relative to the container directory. */
+	Path string;
+
+	/* One of "dir", "file", "symlink", or "device". */
+	Type string;
+
+	/* The mode including the type bits as an os.FileMode. */
+	Mode uint32;
+
+	Uid int;
+	Gid int;
+
+	/* The modification time in nanoseconds since the epoch. */
+	Mtime int64;
+
+	/* The size of a regular file in bytes. */
+	Size int64;
+
+	/* The SHA-256 of a regular file’s content, which names its chunk. */
+	Chunk string;
+
+	/* The target of a symbolic link. */
+	Target string;
+
+	/* The device number of a device, FIFO, or socket. */
+	Rdev uint64;
+}
+
+// Describes a backup of a container.
+type BackupManifest struct {
+
+	/* The name of the backed up container. */
+	Container string;
+
+	/* The identifier of the backup, unique per container. */
+	Id string;
+
+	/* When the backup was taken (seconds since the epoch). */
+	Created int64;
+
+	/* The files of the backup. */
+	Entries []BackupEntry;
+}
+
+// Encapsulates a backup store: a directory holding content-addressed
+// chunks (<dir>/chunks/ab/abcd...) shared by all backups and a manifest per
+// backup (<dir>/manifests/<cname>/<id>). A file whose content is already
+// in the store is never stored twice.
+type BackupStore struct {
+
+	/* The root directory of the backup store. */
+	dir string;
+}
+
+// Returns a new backup store object. Nothing is created on disk until
+// a backup is taken.
+//
+// @param backup_dir The root directory of the store (e.g. "/backups").
+func NewBackupStore(backup_dir string) *BackupStore {
+	return &BackupStore{backup_dir}
+}
+
+// Returns the pathname of the chunk holding content with a given hash,
+// or an error if the hash is malformed (e.g. in a corrupt manifest).
+func (this *BackupStore) GetChunkPathname(chunk string) (string, error) {
+	if !chunk_regexp.MatchString(chunk) {
+		return "", errors.New(fmt.Sprintf("invalid chunk ’%s’", chunk))
+	}
+	return path.Join(this.dir, "chunks", chunk[:2], chunk), nil
+}
+
+// Returns the directory holding the manifests of a container.
+func (this *BackupStore) GetManifestsDirectory(cname string) string {
+	return path.Join(this.dir, "manifests", cname)
+}
+
+// Returns the names of the containers with backups in the store.
+func (this *BackupStore) ListContainers() ([]string, error) {
+	names := make([]string, 0)
+	manifests_dir := path.Join(this.dir, "manifests")
+	if !DirExists(manifests_dir) {
+		return names, nil
+	}
+	entries, err := ioutil.ReadDir(manifests_dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Returns the identifiers of a container’s backups from oldest to newest.
+func (this *BackupStore) ListBackups(cname string) ([]string, error) {
+	ids := make([]string, 0)
+	manifests_dir := this.GetManifestsDirectory(cname)
+	if !DirExists(manifests_dir) {
+		return ids, nil
+	}
+	entries, err := ioutil.ReadDir(manifests_dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			ids = append(ids, entry.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Reads the manifest of a backup.
+//
+// @param cname The name of the backed up container.
+// @param id The backup identifier, or "" for the most recent backup.
+func (this *BackupStore) ReadManifest(cname string, id string) (*BackupManifest, error) {
+	if id == "" {
+		ids, err := this.ListBackups(cname)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, errors.New(fmt.Sprintf("no backups of container ’%s’ in %s", cname, this.dir))
+		}
+		id = ids[len(ids)-1]
+	}
+	manifest_bytes, err := ioutil.ReadFile(path.Join(this.GetManifestsDirectory(cname), id))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	err = json.Unmarshal(manifest_bytes, manifest)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("corrupt manifest %s of container ’%s’: %s", id, cname, err))
+	}
+	return manifest, nil
+}
+
+// Writes a manifest into the store.
+func (this *BackupStore) WriteManifest(manifest *BackupManifest) error {
+	manifests_dir := this.GetManifestsDirectory(manifest.Container)
+	err := os.MkdirAll(manifests_dir, 0700)
+	if err != nil {
+		return err
+	}
+	manifest_bytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifest_pathname := path.Join(manifests_dir, manifest.Id)
+	err = ioutil.WriteFile(manifest_pathname+".tmp", manifest_bytes, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(manifest_pathname+".tmp", manifest_pathname)
+}
+
+// Stores the content of a file as a chunk unless a chunk with the same
+// content already exists. Returns the hash naming the chunk.
+func (this *BackupStore) StoreChunk(pathname string) (string, error) {
+	in, err := os.Open(pathname)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	err = os.MkdirAll(path.Join(this.dir, "chunks"), 0700)
+	if err != nil {
+		return "", err
+	}
+	// Copy into a temporary file while hashing so the file is only
+	// read once; the copy is discarded if the chunk already exists.
+	tmp, err := ioutil.TempFile(path.Join(this.dir, "chunks"), "incoming")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), in)
+	close_err := tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if close_err != nil {
+		return "", close_err
+	}
+	chunk := hex.EncodeToString(hash.Sum(nil))
+	chunk_pathname, err := this.GetChunkPathname(chunk)
+	if err != nil {
+		return "", err
+	}
+	if FileExists(chunk_pathname) {
+		return chunk, nil
+	}
+	err = os.MkdirAll(path.Dir(chunk_pathname), 0700)
+	if err != nil {
+		return "", err
+	}
+	return chunk, os.Rename(tmp.Name(), chunk_pathname)
+}
+
+// Returns nil iff the chunk exists and its content matches its hash.
+func (this *BackupStore) VerifyChunk(chunk string) error {
+	chunk_pathname, err := this.GetChunkPathname(chunk)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(chunk_pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("missing")
+		}
+		return err
+	}
+	defer in.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, in)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != chunk {
+		return errors.New("content does not match its hash")
+	}
+	return nil
+}
+
+// Checks the integrity of every chunk referenced by the manifests of the
+// given containers (all containers when none are given). Each problem is
+// reported on standard error; an error is returned if any were found.
+//
+// @param cnames The containers whose backups to verify.
+func (this *BackupStore) Verify(cnames []string) error {
+	var err error
+	if len(cnames) == 0 {
+		cnames, err = this.ListContainers()
+		if err != nil {
+			return err
+		}
+	}
+	verified := make(map[string]error)
+	nproblems := 0
+	nchunks := 0
+	for _, cname := range cnames {
+		ids, err := this.ListBackups(cname)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			manifest, err := this.ReadManifest(cname, id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				nproblems++
+				continue
+			}
+			for _, entry := range manifest.Entries {
+				if entry.Type != "file" {
+					continue
+				}
+				chunk_err, done := verified[entry.Chunk]
+				if !done {
+					chunk_err = this.VerifyChunk(entry.Chunk)
+					verified[entry.Chunk] = chunk_err
+					nchunks++
+				}
+				if chunk_err != nil {
+					fmt.Fprintf(os.Stderr, "%s/%s: %s: chunk %s %s\n", cname, id, entry.Path, entry.Chunk, chunk_err)
+					nproblems++
+				}
+			}
+		}
+	}
+	if nproblems > 0 {
+		return errors.New(fmt.Sprintf("backup store %s has %d problem(s)", this.dir, nproblems))
+	}
+	fmt.Fprintf(os.Stderr, "verified %d chunk(s) in %s\n", nchunks, this.dir)
+	return nil
+}
+
+// Backs up the meta-data and private data of this container into a backup
+// store. Files whose size, mode, and modification time are unchanged since
+// the container’s previous backup are not read again, and content that is
+// already in the store is not stored again.
+//
+// @param store The backup store to back up into.
+func (this *Container) Backup(store *BackupStore) (*BackupManifest, error) {
+	if !this.IsCreated() {
+		return nil, errors.New("container " + this.name + " has not yet been created")
+	}
+	previous := make(map[string]BackupEntry)
+	last, err := store.ReadManifest(this.name, "")
+	if err == nil {
+		for _, entry := range last.Entries {
+			previous[entry.Path] = entry
+		}
+	}
+	now := time.Now()
+	manifest := &BackupManifest{this.name, now.Format(BACKUP_ID_FORMAT), now.Unix(), make([]BackupEntry, 0)}
+	if FileExists(path.Join(store.GetManifestsDirectory(this.name), manifest.Id)) {
+		return nil, errors.New(fmt.Sprintf("backup %s of container ’%s’ already exists", manifest.Id, this.name))
+	}
+	for _, dir := range backup_dirs {
+		err = filepath.Walk(path.Join(this.cdir, dir), func(pathname string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(this.cdir, pathname)
+			if err != nil {
+				return err
+			}
+			entry := BackupEntry{rel, "", uint32(info.Mode()), 0, 0, info.ModTime().UnixNano(), 0, "", "", 0}
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				entry.Uid = int(stat.Uid)
+				entry.Gid = int(stat.Gid)
+				entry.Rdev = uint64(stat.Rdev)
+			}
+			mode := info.Mode()
+			switch {
+			case mode.IsDir():
+				entry.Type = "dir"
+			case mode&os.ModeSymlink != 0:
+				entry.Type = "symlink"
+				entry.Target, err = os.Readlink(pathname)
+			case mode.IsRegular():
+				entry.Type = "file"
+				entry.Size = info.Size()
+				old, present := previous[rel]
+				if present && old.Type == "file" && old.Size == entry.Size &&
+					old.Mtime == entry.Mtime && old.Mode == entry.Mode {
+					entry.Chunk = old.Chunk
+				} else {
+					entry.Chunk, err = store.StoreChunk(pathname)
+				}
+			default:
+				entry.Type = "device"
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, store.WriteManifest(manifest)
+}
+
+// Restores a backup into a new container and prepares it like Create
+// does. The restored container may be given a different name than the
+// backed up container.
+//
+// @param store The backup store to restore from.
+// @param src_cname The name of the backed up container.
+// @param id The backup identifier, or "" for the most recent backup.
+// @param cname The name of the container to restore into.
+// @param containers_path The path of the containers (e.g. "/web").
+func RestoreContainer(store *BackupStore, src_cname string, id string, cname string, containers_path string) (*Container, error) {
+	manifest, err := store.ReadManifest(src_cname, id)
+	if err != nil {
+		return nil, err
+	}
+	container_dir := path.Join(containers_path, cname)
+	if FileExists(container_dir) {
+		return nil, errors.New("cannot restore container: directory ’" + container_dir + "’ already exists.")
+	}
+	err = os.MkdirAll(container_dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = RestoreBackupEntries(store, manifest, container_dir)
+	if err == nil {
+		err = os.Mkdir(path.Join(container_dir, "rootfs"), 0755)
+	}
+	if err != nil {
+		os.RemoveAll(container_dir)
+		return nil, err
+	}
+	container, err := NewContainerFromImageSetMeta(cname, containers_path)
+	if err != nil {
+		return nil, err
+	}
+	if cname != src_cname {
+		// The MAC addresses, veth pair names, and forwarded host ports
+		// belong to the backed up container.
+		container.ClearNetworkIdentifiers()
+		if len(container.Spec.Ports) > 0 {
+			fmt.Fprintf(os.Stderr, "warning: the ports forwarded to ’%s’ are not forwarded to ’%s’ (see ’qb port’)\n", src_cname, cname)
+			container.Spec.Ports = []PortMapping{}
+		}
+	}
+	return container, container.MountAndConfigure()
+}
+
+// Recreates the files of a backup under a directory.
+//
+// @param store The backup store holding the chunks.
+// @param manifest The manifest of the backup.
+// @param dest_dir The directory to restore into.
+func RestoreBackupEntries(store *BackupStore, manifest *BackupManifest, dest_dir string) error {
+	// Directory modification times change as entries are added, so they
+	// are restored once every entry has been created.
+	dirs := make([]BackupEntry, 0)
+	for _, entry := range manifest.Entries {
+		if strings.HasPrefix(entry.Path, "/") || strings.Contains("/"+entry.Path+"/", "/../") {
+			return errors.New(fmt.Sprintf("refusing to restore unsafe path ’%s’", entry.Path))
+		}
+		pathname := path.Join(dest_dir, entry.Path)
+		mode := os.FileMode(entry.Mode)
+		var err error
+		switch entry.Type {
+		case "dir":
+			err = os.MkdirAll(pathname, 0700)
+			dirs = append(dirs, entry)
+		case "symlink":
+			err = os.Symlink(entry.Target, pathname)
+		case "file":
+			var chunk_pathname string
+			if chunk_pathname, err = store.GetChunkPathname(entry.Chunk); err == nil {
+				err = CopyRegularFile(chunk_pathname, pathname)
+			}
+		case "device":
+			err = syscall.Mknod(pathname, UnixModeBits(mode), int(entry.Rdev))
+		default:
+			err = errors.New(fmt.Sprintf("unknown entry type ’%s’ for %s", entry.Type, entry.Path))
+		}
+		if err != nil {
+			return err
+		}
+		err = os.Lchown(pathname, entry.Uid, entry.Gid)
+		if err != nil {
+			return err
+		}
+		// The mode and times of a symlink are those of its target.
+		if entry.Type == "symlink" {
+			continue
+		}
+		err = os.Chmod(pathname, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err == nil && entry.Type != "dir" {
+			mtime := time.Unix(0, entry.Mtime)
+			err = os.Chtimes(pathname, mtime, mtime)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range dirs {
+		mtime := time.Unix(0, entry.Mtime)
+		os.Chtimes(path.Join(dest_dir, entry.Path), mtime, mtime)
+	}
+	return nil
+}
+
+// Converts an os.FileMode of a device, FIFO, or socket into the mode bits
+// expected by mknod(2).
+func UnixModeBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		bits |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		bits |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		bits |= syscall.S_IFCHR
+	default:
+		bits |= syscall.S_IFBLK
+	}
+	return bits
+}
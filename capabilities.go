@@ -0,0 +1,195 @@
+/// File: capabilities.go
+/// Purpose: Describes the Linux capabilities a container loses as named
+/// profiles rendered into lxc.cap.drop or lxc.cap.keep.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The file holding the number of the host kernel’s last capability.
+const CAP_LAST_CAP_PATH string = "/proc/sys/kernel/cap_last_cap"
+
+// The capabilities LXC accepts in lxc.cap.drop and lxc.cap.keep, in the
+// order of their numbers and named without the cap_ prefix. The legacy
+// configuration keys qb writes require LXC before 3.0, whose capability
+// table ends at audit_read (perfmon, bpf, and checkpoint_restore are
+// unknown to it).
+var known_capabilities = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill",
+	"setgid", "setuid", "setpcap", "linux_immutable", "net_bind_service",
+	"net_broadcast", "net_admin", "net_raw", "ipc_lock", "ipc_owner",
+	"sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct",
+	"sys_admin", "sys_boot", "sys_nice", "sys_resource", "sys_time",
+	"sys_tty_config", "mknod", "lease", "audit_write", "audit_control",
+	"setfcap", "mac_override", "mac_admin", "syslog", "wake_alarm",
+	"block_suspend", "audit_read",
+}
+
+// Describes the capabilities of a container. Either the capabilities to
+// drop or the capabilities to keep are given, since LXC does not allow
+// both.
+type CapabilityProfile struct {
+
+	/* The name of the profile (e.g. "default"). */
+	Name string;
+
+	/* The capabilities the container loses. */
+	Drop []string;
+
+	/* If not empty, the only capabilities the container keeps. */
+	Keep []string;
+}
+
+// The capability profiles containers may use.
+var capability_profiles = map[string]CapabilityProfile{
+	// The capabilities containers have always been started with.
+	"default": {"default", []string{"sys_module"}, nil},
+	// Drops the capabilities that reach beyond the container: the host’s
+	// clock, kernel, hardware, and security modules.
+	"hardened": {"hardened", []string{"sys_module", "sys_rawio", "sys_time", "sys_boot",
+		"sys_pacct", "sys_tty_config", "mac_admin", "mac_override", "syslog",
+		"wake_alarm", "block_suspend", "audit_control"}, nil},
+	// Keeps only what web services running as root need to start up and
+	// drop privileges.
+	"minimal": {"minimal", nil, []string{"chown", "dac_override", "fowner", "fsetid",
+		"kill", "setgid", "setuid", "setpcap", "net_bind_service", "sys_chroot",
+		"mknod", "audit_write", "setfcap"}},
+}
+
+// Returns the names of the capability profiles in sorted order.
+func GetCapabilityProfileNames() []string {
+	names := make([]string, 0, len(capability_profiles))
+	for name, _ := range capability_profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns a copy of the capability profile of a name, which may be
+// changed without changing the profile.
+//
+// @param name The name of the profile (e.g. "hardened").
+func GetCapabilityProfile(name string) (CapabilityProfile, error) {
+	profile, ok := capability_profiles[name]
+	if !ok {
+		return CapabilityProfile{}, errors.New(fmt.Sprintf("invalid capability profile ’%s’: expected one of %s",
+			name, strings.Join(GetCapabilityProfileNames(), ", ")))
+	}
+	if profile.Drop != nil {
+		profile.Drop = append([]string{}, profile.Drop...)
+	}
+	if profile.Keep != nil {
+		profile.Keep = append([]string{}, profile.Keep...)
+	}
+	return profile, nil
+}
+
+// Returns the default capability profile.
+func NewDefaultCapabilityProfile() CapabilityProfile {
+	profile, _ := GetCapabilityProfile("default")
+	return profile
+}
+
+// Returns the number of the host kernel’s last capability, or the number
+// of the last capability LXC accepts if the kernel does not say.
+func GetLastCapability() int {
+	last := len(known_capabilities) - 1
+	content, err := ioutil.ReadFile(CAP_LAST_CAP_PATH)
+	if err != nil {
+		return last
+	}
+	if number, err := strconv.Atoi(strings.TrimSpace(string(content))); err == nil && number < last {
+		return number
+	}
+	return last
+}
+
+// Returns the name of a capability as used in the LXC configuration, or
+// an error if LXC does not know it. The name may be given in upper case
+// and with a cap_ prefix (e.g. CAP_SYS_ADMIN).
+func ValidateCapabilityName(name string) (string, error) {
+	normalized := strings.TrimPrefix(strings.ToLower(name), "cap_")
+	for _, capability := range known_capabilities {
+		if capability == normalized {
+			return normalized, nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("unknown capability ’%s’", name))
+}
+
+// Returns true iff the host’s kernel knows a capability named as in the
+// LXC configuration, i.e. its number is at most cap_last_cap.
+func IsCapabilitySupported(name string) bool {
+	for _, capability := range known_capabilities[:GetLastCapability()+1] {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns nil iff the profile names only known capabilities and does not
+// both drop and keep capabilities.
+func (this *CapabilityProfile) Validate() error {
+	if len(this.Drop) > 0 && len(this.Keep) > 0 {
+		return errors.New(fmt.Sprintf("capability profile ’%s’ both drops and keeps capabilities", this.Name))
+	}
+	for _, names := range [][]string{this.Drop, this.Keep} {
+		for _, name := range names {
+			if _, err := ValidateCapabilityName(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the capabilities the container keeps, in the order of their
+// numbers. Capabilities the host’s kernel does not know are left out.
+func (this *CapabilityProfile) GetEffectiveCapabilities() []string {
+	listed := make(map[string]bool)
+	for _, name := range append(append([]string{}, this.Drop...), this.Keep...) {
+		normalized, _ := ValidateCapabilityName(name)
+		listed[normalized] = true
+	}
+	effective := make([]string, 0)
+	for _, capability := range known_capabilities[:GetLastCapability()+1] {
+		if listed[capability] == (len(this.Keep) > 0) {
+			effective = append(effective, capability)
+		}
+	}
+	return effective
+}
+
+// Returns a copy of an LXC configuration with lxc.cap.drop or
+// lxc.cap.keep set to the profile. Capabilities the host’s kernel does
+// not know are left out, since no process can hold them.
+func (this *CapabilityProfile) ApplyTo(info CgroupInfo) (CgroupInfo, error) {
+	if err := this.Validate(); err != nil {
+		return nil, err
+	}
+	result := make(CgroupInfo)
+	for key, values := range info {
+		if key != "lxc.cap.drop" && key != "lxc.cap.keep" {
+			result[key] = values
+		}
+	}
+	key, names := "lxc.cap.drop", this.Drop
+	if len(this.Keep) > 0 {
+		key, names = "lxc.cap.keep", this.Keep
+	}
+	for _, name := range names {
+		if normalized, _ := ValidateCapabilityName(name); IsCapabilitySupported(normalized) {
+			result[key] = append(result[key], normalized)
+		}
+	}
+	return result, nil
+}
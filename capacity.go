@@ -0,0 +1,243 @@
+/// File: capacity.go
+/// Purpose: Sums the memory and CPUs reserved by running containers and
+/// admits containers only while the reservations fit the host’s capacity.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The file the host’s total memory is read from.
+const MEMINFO_PATH string = "/proc/meminfo"
+
+// The lock held from an admission check until the change it admitted is
+// made, relative to the containers path.
+const ADMISSION_LOCK_FILENAME string = ".admission.lock"
+
+// Describes the memory and CPUs reserved by containers or available to
+// them.
+type Reservation struct {
+
+	/* The memory in bytes. */
+	Memory int64;
+
+	/* The number of CPUs. */
+	Cpus float64;
+}
+
+// Describes the host’s capacity and the reservations of its running
+// containers.
+type CapacityReport struct {
+
+	/* The memory and CPUs of the host, before overcommitting. */
+	Capacity Reservation;
+
+	/* The memory and CPUs containers may reserve, the capacity multiplied
+	   by the overcommit ratios. */
+	Limit Reservation;
+
+	/* The reservations of the running containers keyed by name. */
+	Running map[string]Reservation;
+
+	/* The sum of the reservations of the running containers. */
+	Reserved Reservation;
+}
+
+// Returns the host’s total memory in bytes as reported by /proc/meminfo.
+func GetHostMemory() (int64, error) {
+	file, err := os.Open(MEMINFO_PATH)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kilobytes, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("%s: invalid MemTotal ’%s’", MEMINFO_PATH, fields[1]))
+		}
+		return kilobytes << 10, nil
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New(fmt.Sprintf("%s: no MemTotal", MEMINFO_PATH))
+}
+
+// Returns the memory and CPUs of the host: the configured capacity, or
+// the host’s total memory and online CPUs where none is configured.
+//
+// @param config The host configuration.
+func GetHostCapacity(config *HostConfig) (Reservation, error) {
+	capacity := Reservation{config.Capacity_memory, config.Capacity_cpus}
+	if capacity.Memory == 0 {
+		memory, err := GetHostMemory()
+		if err != nil {
+			return capacity, err
+		}
+		capacity.Memory = memory
+	}
+	if capacity.Cpus == 0 {
+		online, err := GetOnlineCpus()
+		if err != nil {
+			return capacity, err
+		}
+		capacity.Cpus = float64(len(online))
+	}
+	return capacity, nil
+}
+
+// Returns the memory and CPUs reserved by a container with the
+// resources: its memory limit and its CPU quota, or the number of CPUs
+// in its cpuset if it has no quota. A container without limits reserves
+// nothing.
+func (this *Resources) GetReservation() Reservation {
+	reservation := Reservation{this.Memory, this.Cpus}
+	if reservation.Cpus == 0 && this.Cpuset != "" {
+		if cpus, err := ParseCpuList(this.Cpuset); err == nil {
+			reservation.Cpus = float64(len(cpus))
+		}
+	}
+	return reservation
+}
+
+// Takes the admission lock of the containers under a containers path.
+// It is held from an admission check until the change admitted is made
+// (e.g. the container is started) so that concurrent changes cannot all
+// be admitted against the same reservations. Close the file to release
+// it.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+func LockAdmission(containers_path string) (*os.File, error) {
+	return LockFile(path.Join(containers_path, ADMISSION_LOCK_FILENAME))
+}
+
+// Returns the host’s capacity and the reservations of the running
+// containers under a containers path.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param config The host configuration.
+func GetCapacityReport(containers_path string, config *HostConfig) (*CapacityReport, error) {
+	capacity, err := GetHostCapacity(config)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := ListContainers(containers_path)
+	if err != nil {
+		return nil, err
+	}
+	report := &CapacityReport{capacity,
+		Reservation{int64(float64(capacity.Memory) * config.Memory_overcommit), capacity.Cpus * config.Cpu_overcommit},
+		make(map[string]Reservation), Reservation{}}
+	for _, container := range containers {
+		if !container.IsRunning() {
+			continue
+		}
+		reservation := container.Spec.Resources.GetReservation()
+		report.Running[container.name] = reservation
+		report.Reserved.Memory += reservation.Memory
+		report.Reserved.Cpus += reservation.Cpus
+	}
+	return report, nil
+}
+
+// Returns nil iff the container may reserve memory and CPUs: the
+// reservations of the running containers other than it plus its own do
+// not exceed the memory or CPUs containers may reserve, or its own do not
+// grow (a container is never refused for reserving nothing or less than
+// it does). Depending on the host configuration’s ’admission’ setting, a
+// container that does not fit is refused with an error or admitted with
+// a warning. The caller should hold the admission lock.
+//
+// @param requested The memory and CPUs the container is to reserve.
+func (this *Container) CheckAdmission(requested Reservation) error {
+	config, err := GetHostConfig()
+	if err != nil {
+		return err
+	}
+	if config.Admission == "off" {
+		return nil
+	}
+	report, err := GetCapacityReport(this.GetContainersPath(), config)
+	if err != nil {
+		return err
+	}
+	current := report.Running[this.name]
+	reserved := report.Reserved
+	reserved.Memory -= current.Memory
+	reserved.Cpus -= current.Cpus
+	problems := make([]string, 0)
+	if requested.Memory > current.Memory && reserved.Memory + requested.Memory > report.Limit.Memory {
+		problems = append(problems, fmt.Sprintf("memory %s reserved + %s requested exceeds %s",
+			FormatApproximateByteSize(uint64(reserved.Memory)), FormatApproximateByteSize(uint64(requested.Memory)),
+			FormatApproximateByteSize(uint64(report.Limit.Memory))))
+	}
+	// Allow for rounding in the sums of fractional CPUs.
+	if requested.Cpus > current.Cpus && reserved.Cpus + requested.Cpus > report.Limit.Cpus + 1e-9 {
+		problems = append(problems, fmt.Sprintf("cpus %g reserved + %g requested exceeds %g",
+			reserved.Cpus, requested.Cpus, report.Limit.Cpus))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return ApplyAdmissionPolicy(config, fmt.Sprintf("container ’%s’ exceeds the host’s capacity: %s",
+		this.name, strings.Join(problems, "; ")))
+}
+
+// Returns nil iff a container may be created: the running containers do
+// not already reserve more memory or CPUs than containers may reserve. A
+// new container reserves nothing, but it should not be added to a host
+// that is already overcommitted. Depending on the host configuration’s
+// ’admission’ setting, the container is refused with an error or created
+// with a warning.
+func (this *Container) CheckCreateAdmission() error {
+	config, err := GetHostConfig()
+	if err != nil {
+		return err
+	}
+	if config.Admission == "off" {
+		return nil
+	}
+	report, err := GetCapacityReport(this.GetContainersPath(), config)
+	if err != nil {
+		return err
+	}
+	problems := make([]string, 0)
+	if report.Reserved.Memory > report.Limit.Memory {
+		problems = append(problems, fmt.Sprintf("memory %s reserved exceeds %s",
+			FormatApproximateByteSize(uint64(report.Reserved.Memory)), FormatApproximateByteSize(uint64(report.Limit.Memory))))
+	}
+	if report.Reserved.Cpus > report.Limit.Cpus + 1e-9 {
+		problems = append(problems, fmt.Sprintf("cpus %g reserved exceeds %g", report.Reserved.Cpus, report.Limit.Cpus))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return ApplyAdmissionPolicy(config, fmt.Sprintf("cannot create container ’%s’: the running containers exceed the host’s capacity: %s",
+		this.name, strings.Join(problems, "; ")))
+}
+
+// Returns an error describing a container that does not fit the host’s
+// capacity, or prints it as a warning and returns nil if the host
+// configuration’s ’admission’ setting is "warn".
+//
+// @param config The host configuration.
+// @param message The description of the problem.
+func ApplyAdmissionPolicy(config *HostConfig, message string) error {
+	if config.Admission == "warn" {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", message)
+		return nil
+	}
+	return errors.New(message)
+}
@@ -0,0 +1,219 @@
+/// File: cgroup2.go
+/// Purpose: Detects the host’s cgroup version and translates container
+/// resources to the settings of the unified (v2) hierarchy.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The root of the host’s cgroup hierarchy.
+const CGROUP_ROOT string = "/sys/fs/cgroup"
+
+// The oldest LXC that can run containers on a cgroup v2 host: its
+// lxc.cgroup2 keys, including device rules, arrived in LXC 4.0.
+const MIN_LXC_MAJOR_VERSION_FOR_CGROUP_V2 int = 4
+
+// The legacy configuration keys renamed in LXC 3.0, which no longer
+// accepts them, keyed by legacy name. An empty name means the key was
+// removed.
+var lxc3_key_names = map[string]string{
+	"lxc.utsname": "lxc.uts.name",
+	"lxc.tty": "lxc.tty.max",
+	"lxc.pts": "lxc.pty.max",
+	"lxc.devttydir": "lxc.tty.dir",
+	"lxc.rootfs": "lxc.rootfs.path",
+	"lxc.mount": "lxc.mount.fstab",
+	"lxc.seccomp": "lxc.seccomp.profile",
+	"lxc.id_map": "lxc.idmap",
+	"lxc.pivotdir": "",
+}
+
+// The lxc.network.* keys renamed in LXC 3.0 (beyond becoming
+// lxc.net.N.*), keyed by legacy name without the prefix.
+var lxc3_network_key_names = map[string]string{
+	"ipv4": "ipv4.address",
+	"ipv6": "ipv6.address",
+}
+
+// The filesystem magic of cgroup2 (CGROUP2_SUPER_MAGIC).
+const CGROUP2_SUPER_MAGIC int64 = 0x63677270
+
+// Returns 2 if the host mounts the unified cgroup hierarchy at
+// /sys/fs/cgroup and 1 otherwise.
+func GetHostCgroupVersion() int {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(CGROUP_ROOT, &stat); err == nil && int64(stat.Type) == CGROUP2_SUPER_MAGIC {
+		return 2
+	}
+	return 1
+}
+
+// Returns the cgroup v2 cpu.weight (1-10000) equivalent to cgroup v1
+// cpu.shares (2-262144).
+func GetCpuWeightFromShares(shares int) int {
+	return 1 + ((shares-2)*9999)/262142
+}
+
+// Returns the major and minor version of the installed LXC as reported by
+// ’lxc-start --version’ (e.g. 2 and 0 for "2.0.11").
+func GetLXCVersion() (int, int, error) {
+	out, err := exec.Command("lxc-start", "--version").Output()
+	if err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("cannot determine the LXC version: %s", err))
+	}
+	version := strings.TrimSpace(string(out))
+	parts := strings.SplitN(version, ".", 3)
+	major, major_err := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	if major_err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("cannot parse the LXC version ’%s’", version))
+	}
+	return major, minor, nil
+}
+
+// Returns a rendered LXC configuration with the legacy keys renamed as
+// LXC 3.0 and later require. Each lxc.network.type starts a new
+// lxc.net.N interface.
+//
+// @param config The configuration in the legacy ’key = value’ form.
+func TranslateConfigToLXC3(config []byte) []byte {
+	result := make([]byte, 0, len(config))
+	network := -1
+	for _, line := range strings.SplitAfter(string(config), "\n") {
+		eq := strings.Index(line, " = ")
+		if eq == -1 {
+			result = append(result, line...)
+			continue
+		}
+		key, rest := line[:eq], line[eq:]
+		if new_key, renamed := lxc3_key_names[key]; renamed {
+			if new_key == "" {
+				continue
+			}
+			key = new_key
+		} else if strings.HasPrefix(key, "lxc.network.") {
+			name := strings.TrimPrefix(key, "lxc.network.")
+			if name == "type" {
+				network++
+			}
+			if new_name, renamed := lxc3_network_key_names[name]; renamed {
+				name = new_name
+			}
+			key = fmt.Sprintf("lxc.net.%d.%s", network, name)
+		}
+		result = append(result, (key + rest)...)
+	}
+	return result
+}
+
+// Returns a rendered LXC configuration adapted to the installed LXC: the
+// legacy keys are renamed for LXC 3.0 and later. Returns an error on a
+// cgroup v2 host unless LXC is at least 4.0, since older versions cannot
+// apply lxc.cgroup2 keys. On a cgroup v1 host, the configuration is kept
+// as is if the LXC version cannot be determined.
+//
+// @param config The configuration in the legacy ’key = value’ form.
+func AdaptConfigToInstalledLXC(config []byte) ([]byte, error) {
+	major, minor, err := GetLXCVersion()
+	if GetHostCgroupVersion() == 2 {
+		if err != nil {
+			return nil, err
+		}
+		if major < MIN_LXC_MAJOR_VERSION_FOR_CGROUP_V2 {
+			return nil, errors.New(fmt.Sprintf("this host uses cgroup v2, which requires LXC %d.0 or later (LXC %d.%d is installed)",
+				MIN_LXC_MAJOR_VERSION_FOR_CGROUP_V2, major, minor))
+		}
+	}
+	if err != nil || major < 3 {
+		return config, nil
+	}
+	return TranslateConfigToLXC3(config), nil
+}
+
+// Returns the cgroup v2 io.weight (1-10000) equivalent to a cgroup v1
+// blkio weight (10-1000).
+func GetIoWeightFromBlkioWeight(weight int) int {
+	return 1 + ((weight-10)*9999)/990
+}
+
+// Returns the cgroup v2 settings implementing the resources, keyed by
+// controller file (e.g. "memory.max").
+func (this *Resources) GetCgroupV2Settings() (map[string][]string, error) {
+	settings := make(map[string][]string)
+	if this.Blkio_weight != 0 {
+		settings["io.weight"] = []string{fmt.Sprintf("default %d", GetIoWeightFromBlkioWeight(this.Blkio_weight))}
+	}
+	if this.Memory != 0 {
+		settings["memory.max"] = []string{strconv.FormatInt(this.Memory, 10)}
+		if this.Swap != 0 {
+			// Unlike memory.memsw.limit_in_bytes, memory.swap.max
+			// excludes memory.
+			settings["memory.swap.max"] = []string{strconv.FormatInt(this.Swap, 10)}
+		}
+	}
+	if this.Cpu_shares != 0 {
+		settings["cpu.weight"] = []string{strconv.Itoa(GetCpuWeightFromShares(this.Cpu_shares))}
+	}
+	if this.Cpus != 0 {
+		settings["cpu.max"] = []string{fmt.Sprintf("%d %d", int64(this.Cpus*float64(CPU_PERIOD_US)), CPU_PERIOD_US)}
+	}
+	if this.Cpuset != "" {
+		settings["cpuset.cpus"] = []string{this.Cpuset}
+	}
+	for _, limit := range this.Blkio_devices {
+		if limit.Weight != 0 {
+			settings["io.weight"] = append(settings["io.weight"],
+				fmt.Sprintf("%s %d", limit.Device, GetIoWeightFromBlkioWeight(limit.Weight)))
+		}
+		// Every key is written since io.max keeps the keys a write
+		// leaves out.
+		line, limited := limit.Device, false
+		for _, throttle := range []struct {
+			key string
+			value int64
+		}{{"rbps", limit.Read_bps}, {"wbps", limit.Write_bps}, {"riops", limit.Read_iops}, {"wiops", limit.Write_iops}} {
+			if throttle.value != 0 {
+				line += fmt.Sprintf(" %s=%d", throttle.key, throttle.value)
+				limited = true
+			} else {
+				line += fmt.Sprintf(" %s=max", throttle.key)
+			}
+		}
+		if limited {
+			settings["io.max"] = append(settings["io.max"], line)
+		}
+	}
+	if this.Pids != 0 {
+		settings["pids.max"] = []string{strconv.FormatInt(this.Pids, 10)}
+	}
+	return settings, nil
+}
+
+// Returns a copy of a configuration map for a cgroup v2 host: the device
+// rules are moved to their lxc.cgroup2 keys, and any other cgroup v1 key
+// is rejected since it has no direct v2 equivalent.
+func TranslateCgroupInfoToV2(info CgroupInfo) (CgroupInfo, error) {
+	result := make(CgroupInfo)
+	for key, values := range info {
+		if !strings.HasPrefix(key, "lxc.cgroup.") {
+			result[key] = values
+			continue
+		}
+		file := strings.TrimPrefix(key, "lxc.cgroup.")
+		if file != "devices.allow" && file != "devices.deny" {
+			return nil, errors.New(fmt.Sprintf("%s has no cgroup v2 equivalent - set the container’s resources instead", key))
+		}
+		result["lxc.cgroup2."+file] = values
+	}
+	return result, nil
+}
@@ -0,0 +1,252 @@
+/// File: cgroupfs.go
+/// Purpose: Reads and writes the cgroup files of running containers so
+/// resources can be changed without restarting them.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The values that remove a cgroup v1 limit, keyed by controller file.
+var cgroup_v1_unlimited = map[string]string{
+	"memory.limit_in_bytes": "-1",
+	"memory.memsw.limit_in_bytes": "-1",
+	"cpu.shares": "1024",
+	"cpu.cfs_quota_us": "-1",
+	"cpu.cfs_period_us": "100000",
+	"blkio.weight": "500",
+	"pids.max": "max",
+}
+
+// The values that remove a cgroup v2 limit, keyed by controller file.
+var cgroup_v2_unlimited = map[string]string{
+	"memory.max": "max",
+	"memory.swap.max": "max",
+	"cpu.weight": "100",
+	"cpu.max": "max 100000",
+	"cpuset.cpus": "",
+	"pids.max": "max",
+}
+
+// Describes a cgroup value the kernel rejected.
+type CgroupWriteError struct {
+	File string;
+	Value string;
+	Err error;
+}
+
+// Returns the process id of the container’s init process, or an error if
+// the container is not running.
+func (this *Container) GetInitPid() (int, error) {
+	out, err := exec.Command("lxc-info", "-n", this.name, "-p").Output()
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("container ’%s’ is not running", this.name))
+	}
+	// lxc-info prints e.g. "pid:          1234" or "PID: 1234".
+	fields := strings.Fields(string(out))
+	if len(fields) == 2 {
+		if pid, err := strconv.Atoi(fields[1]); err == nil && pid > 0 {
+			return pid, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("container ’%s’ is not running", this.name))
+}
+
+// Returns the directory of the container’s cgroup holding a controller’s
+// files (e.g. "memory"). The legacy layout with every controller mounted at
+// /cgroup is used if present; otherwise the cgroup of the container’s init
+// process is looked up.
+//
+// @param controller The name of the controller.
+func (this *Container) GetCgroupDirectory(controller string) (string, error) {
+	legacy_dir := path.Join("/cgroup/lxc", this.name)
+	if DirExists(legacy_dir) {
+		return legacy_dir, nil
+	}
+	pid, err := this.GetInitPid()
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Each line has the form ID:CONTROLLERS:PATH; the unified
+		// hierarchy has ID 0 and no controllers.
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			return path.Join(CGROUP_ROOT, fields[2]), nil
+		}
+		for _, name := range strings.Split(fields[1], ",") {
+			if name == controller {
+				return path.Join(CGROUP_ROOT, controller, fields[2]), nil
+			}
+		}
+	}
+	return "", errors.New(fmt.Sprintf("container ’%s’ is not in a %s cgroup", this.name, controller))
+}
+
+// Returns the pathname of one of the container’s cgroup files (e.g.
+// "memory.max").
+func (this *Container) GetCgroupFile(file string) (string, error) {
+	dir, err := this.GetCgroupDirectory(strings.SplitN(file, ".", 2)[0])
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, file), nil
+}
+
+// Reads one of the container’s cgroup files.
+func (this *Container) ReadCgroupFile(file string) (string, error) {
+	pathname, err := this.GetCgroupFile(file)
+	if err != nil {
+		return "", err
+	}
+	value_bytes, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value_bytes)), nil
+}
+
+// Writes a value into one of the container’s cgroup files.
+func (this *Container) WriteCgroupFile(file string, value string) error {
+	pathname, err := this.GetCgroupFile(file)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pathname, []byte(value), 0644)
+}
+
+// Returns the values that remove device limits of a cgroup file.
+//
+// @param version The cgroup version.
+// @param file The controller file (e.g. "io.max").
+// @param lines The device lines being removed (e.g. "8:0 100").
+func GetDeviceResetValues(version int, file string, lines []string) []string {
+	values := make([]string, 0)
+	for _, line := range lines {
+		device := strings.Fields(line)[0]
+		if version == 2 && file == "io.weight" {
+			// The default weight is 100; a device weight is removed by
+			// setting it to the default.
+			if device == "default" {
+				values = append(values, "default 100")
+			} else {
+				values = append(values, device+" default")
+			}
+		} else if version == 2 {
+			values = append(values, device+" rbps=max wbps=max riops=max wiops=max")
+		} else {
+			values = append(values, device+" 0")
+		}
+	}
+	return values
+}
+
+// Returns the cgroup file writes changing a running container’s resources
+// from old to new. Limits that are removed are reset to unlimited.
+//
+// @param version The cgroup version.
+// @param old_settings The settings of the old resources.
+// @param new_settings The settings of the new resources.
+func GetCgroupResourceWrites(version int, old_settings map[string][]string, new_settings map[string][]string) ([][2]string, error) {
+	unlimited := cgroup_v1_unlimited
+	if version == 2 {
+		unlimited = cgroup_v2_unlimited
+	}
+	files := make([]string, 0)
+	for file, _ := range old_settings {
+		if new_settings[file] == nil {
+			files = append(files, file)
+		}
+	}
+	for file, _ := range new_settings {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	writes := make([][2]string, 0)
+	for _, file := range files {
+		values, present := new_settings[file]
+		if !present {
+			reset, known := unlimited[file]
+			switch {
+			case known:
+				values = []string{reset}
+			case strings.Contains(old_settings[file][0], " "):
+				values = GetDeviceResetValues(version, file, old_settings[file])
+			default:
+				return nil, errors.New(fmt.Sprintf("cannot remove %s from a running container - restart it instead", file))
+			}
+		} else if strings.Contains(values[0], " ") && file != "cpu.max" {
+			// Devices no longer limited are reset before the rest
+			// are written.
+			removed := make([]string, 0)
+			for _, old_line := range old_settings[file] {
+				kept := false
+				for _, line := range values {
+					kept = kept || strings.Fields(line)[0] == strings.Fields(old_line)[0]
+				}
+				if !kept {
+					removed = append(removed, old_line)
+				}
+			}
+			values = append(GetDeviceResetValues(version, file, removed), values...)
+		}
+		for _, value := range values {
+			writes = append(writes, [2]string{file, value})
+		}
+	}
+	return writes, nil
+}
+
+// Writes new resources into the cgroup files of the running container.
+// Every write is attempted; the writes the kernel rejected are returned.
+// On cgroup v1, the memory+swap limit is written first when the memory
+// limit grows since it may never be below the memory limit.
+//
+// @param old_resources The resources the container runs with.
+// @param new_resources The resources to apply.
+func (this *Container) ApplyResourcesLive(old_resources *Resources, new_resources *Resources) ([]CgroupWriteError, error) {
+	version := GetHostCgroupVersion()
+	old_settings, err := old_resources.GetCgroupSettings(version)
+	if err != nil {
+		old_settings = make(map[string][]string)
+	}
+	new_settings, err := new_resources.GetCgroupSettings(version)
+	if err != nil {
+		return nil, err
+	}
+	writes, err := GetCgroupResourceWrites(version, old_settings, new_settings)
+	if err != nil {
+		return nil, err
+	}
+	if version == 1 && (new_resources.Memory == 0 || new_resources.Memory > old_resources.Memory) {
+		sort.SliceStable(writes, func(i, j int) bool {
+			return writes[i][0] == "memory.memsw.limit_in_bytes" && writes[j][0] != "memory.memsw.limit_in_bytes"
+		})
+	}
+	rejected := make([]CgroupWriteError, 0)
+	for _, write := range writes {
+		if err := this.WriteCgroupFile(write[0], write[1]); err != nil {
+			rejected = append(rejected, CgroupWriteError{write[0], write[1], err})
+		}
+	}
+	return rejected, nil
+}
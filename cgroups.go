@@ -22,6 +22,9 @@ func GetCGroupKeys() []string {
 		"lxc.mount",
 		"lxc.arch",
 		"lxc.cap.drop",
+		"lxc.cap.keep",
+		"lxc.seccomp",
+		"lxc.id_map",
 		"lxc.pivotdir",
 		"lxc.network.type",
 		"lxc.network.flags",
@@ -40,6 +43,8 @@ func GetCGroupKeys() []string {
 		"lxc.cgroup.devices.deny",
 		"lxc.cgroup.devices.allow",
 		"lxc.cgroup.cpu.shares",
+		"lxc.cgroup.cpu.cfs_period_us",
+		"lxc.cgroup.cpu.cfs_quota_us",
 		"lxc.cgroup.memory.force_empty",
 		"lxc.cgroup.memory.limit_in_bytes",
 		"lxc.cgroup.memory.memsw.limit_in_bytes",
@@ -67,6 +72,17 @@ func GetCGroupKeys() []string {
 		"lxc.cgroup.blkio.throttle.write_iops_device",
 		"lxc.cgroup.blkio.weight",
 		"lxc.cgroup.blkio.weight_device",
+		"lxc.cgroup.pids.max",
+		"lxc.cgroup2.devices.deny",
+		"lxc.cgroup2.devices.allow",
+		"lxc.cgroup2.memory.max",
+		"lxc.cgroup2.memory.swap.max",
+		"lxc.cgroup2.cpu.weight",
+		"lxc.cgroup2.cpu.max",
+		"lxc.cgroup2.cpuset.cpus",
+		"lxc.cgroup2.io.max",
+		"lxc.cgroup2.io.weight",
+		"lxc.cgroup2.pids.max",
 	};
 }
 
@@ -111,6 +127,7 @@ func GetCgroupInfoBytes(info CgroupInfo) ([]byte, error) {
 // Returns a pre-populated map of a default LXC configuration given
 // a container name, root filesystem, and fstab
 func GetDefaultCgroupInfo(container_name string, rootfs string, fstab string) CgroupInfo {
+	var devices = NewDefaultDevicePolicy()
 	var info = CgroupInfo {
 		"lxc.utsname": {container_name},
 			"lxc.tty": {"4"},
@@ -125,9 +142,7 @@ func GetDefaultCgroupInfo(container_name string, rootfs string, fstab string) Cg
 			"lxc.network.link": {"br0"},
 			"lxc.network.ipv4": {"0.0.0.0"},
 			"lxc.cgroup.devices.deny": {"a"},
-			"lxc.cgroup.devices.allow": {"c *:* m", "b *:* m", "c 1:3 rwm", "c 1:5 rwm", "c 5:1 rwm",
-			"c 5:0 rwm", "c 4:0 rwm", "c 4:1 rwm", "c 1:9 rwm", "c 1:8 rwm", "c 136:* rwm",
-			"c 5:2 rwm", "c 254:0 rwm", "c 10:229 rwm", "c 10:200 rwm"},
+			"lxc.cgroup.devices.allow": devices.GetAllowStrings(),
 		}
 	return info;
 }
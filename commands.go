@@ -187,6 +187,22 @@ func (this *FIFOCommand) WaitUntilServerIsAlive() error {
 	return this.ExecuteDaemonOnServerWithCallback([]string{"@alive",}, nil)
 }
 
+/// CLIENT: Checks whether a command server holds the daemon lock, without
+/// sending it a request.
+func (this *FIFOCommand) IsServerAlive() bool {
+	lock_file, err := os.Open(this.Filename + "˜")
+	if err != nil {
+		return false
+	}
+	defer lock_file.Close()
+	err = syscall.Flock(lock_file.Fd(), syscall.LOCK_SH | syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(lock_file.Fd(), syscall.LOCK_UN)
+		return false
+	}
+	return err == syscall.EWOULDBLOCK
+}
+
 /// CLIENT: Executes a command as a daemon on the server without waiting.
 func (this *FIFOCommand) ExecuteDaemonOnServer(args []string) error {
 	err := this.ExecuteDaemonOnServerWithCallback(args, nil)
@@ -0,0 +1,257 @@
+/// File: config.go
+/// Purpose: Loads the host-wide quickbuddy configuration, which describes
+/// resources shared by all containers (e.g. the container subnet).
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The default pathname of the host configuration.
+const DEFAULT_HOST_CONFIG_PATH string = "/etc/quickbuddy.conf"
+
+// The subnet containers are addressed from when none is configured.
+const DEFAULT_SUBNET string = "10.0.3.0/24"
+
+// Encapsulates the host configuration. The configuration file has the
+// same form as an LXC configuration: one ’key = value’ per line with
+// ’#’ starting a comment. A missing file yields the defaults.
+type HostConfig struct {
+
+	/* The subnet containers are addressed from (key ’subnet’). */
+	Subnet *net.IPNet;
+
+	/* The gateway of the subnet (key ’gateway’), the first address of
+	   the subnet by default. */
+	Gateway net.IP;
+
+	/* The bridge veth interfaces are attached to by default (key
+	   ’bridge’). */
+	Bridge string;
+
+	/* The name servers written into containers’ interfaces files (key
+	   ’nameserver’, may be repeated). */
+	Nameservers []net.IP;
+
+	/* The IPv6 prefix containers are addressed from (key ’subnet6’), or
+	   nil if containers have no IPv6 addresses. */
+	Subnet6 *net.IPNet;
+
+	/* The IPv6 gateway (key ’gateway6’), the first address of the
+	   prefix by default. */
+	Gateway6 net.IP;
+
+	/* The dnsmasq hosts file mapping containers’ MAC addresses to their
+	   addresses and names (key ’dhcp_hosts’). */
+	Dhcp_hosts string;
+
+	/* The pid file of the DHCP server to signal when the hosts file
+	   changes (key ’dhcp_pid_file’), or "" for none. */
+	Dhcp_pid_file string;
+
+	/* The user whose subordinate ids are allocated to containers using
+	   user namespaces (key ’subid_user’). */
+	Subid_user string;
+
+	/* The files listing subordinate uids and gids in the user:start:count
+	   form of /etc/subuid (keys ’subuid_file’ and ’subgid_file’). */
+	Subuid_file string;
+	Subgid_file string;
+
+	/* The memory and CPUs containers may reserve before overcommitting
+	   (keys ’capacity_memory’ and ’capacity_cpus’), or 0 for the host’s
+	   total memory and online CPUs. */
+	Capacity_memory int64;
+	Capacity_cpus float64;
+
+	/* How many times the capacity may be reserved (keys
+	   ’memory_overcommit’ and ’cpu_overcommit’). */
+	Memory_overcommit float64;
+	Cpu_overcommit float64;
+
+	/* What happens when a container would exceed the capacity (key
+	   ’admission’): "refuse", "warn", or "off". */
+	Admission string;
+}
+
+// Returns a new host configuration holding the defaults.
+func NewDefaultHostConfig() *HostConfig {
+	_, subnet, _ := net.ParseCIDR(DEFAULT_SUBNET)
+	return &HostConfig{subnet, GetNthAddress(subnet, 1), "br0", []net.IP{}, nil, nil,
+		DEFAULT_DHCP_HOSTS_PATH, "", "root", "/etc/subuid", "/etc/subgid", 0, 0, 1, 1, "refuse"}
+}
+
+// Loads the host configuration from the default pathname.
+func GetHostConfig() (*HostConfig, error) {
+	return LoadHostConfig(DEFAULT_HOST_CONFIG_PATH)
+}
+
+// Loads the host configuration from a file.
+//
+// @param pathname The pathname of the configuration file.
+func LoadHostConfig(pathname string) (*HostConfig, error) {
+	config := NewDefaultHostConfig()
+	file, err := os.Open(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	gateway_set, gateway6_set := false, false
+	reader := bufio.NewReader(file)
+	line_no := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line_no++
+		if comment_index := strings.Index(line, "#"); comment_index != -1 {
+			line = line[:comment_index]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			eq := strings.Index(line, "=")
+			if eq == -1 {
+				return nil, errors.New(fmt.Sprintf("%s line %d: expected ’key = value’", pathname, line_no))
+			}
+			key := strings.TrimSpace(line[:eq])
+			value := strings.TrimSpace(line[eq+1:])
+			parse_err := config.Set(key, value)
+			if parse_err != nil {
+				return nil, errors.New(fmt.Sprintf("%s line %d: %s", pathname, line_no, parse_err))
+			}
+			if key == "gateway" {
+				gateway_set = true
+			} else if key == "gateway6" {
+				gateway6_set = true
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if !gateway_set {
+		config.Gateway = GetNthAddress(config.Subnet, 1)
+	}
+	if !config.Subnet.Contains(config.Gateway) {
+		return nil, errors.New(fmt.Sprintf("%s: gateway %s is not in subnet %s", pathname, config.Gateway, config.Subnet))
+	}
+	if config.Subnet6 == nil {
+		if gateway6_set {
+			return nil, errors.New(fmt.Sprintf("%s: gateway6 requires subnet6", pathname))
+		}
+		return config, nil
+	}
+	if !gateway6_set {
+		config.Gateway6 = GetNthAddress(config.Subnet6, 1)
+	}
+	if !config.Subnet6.Contains(config.Gateway6) {
+		return nil, errors.New(fmt.Sprintf("%s: gateway6 %s is not in subnet6 %s", pathname, config.Gateway6, config.Subnet6))
+	}
+	return config, nil
+}
+
+// Sets one configuration value.
+//
+// @param key The configuration key.
+// @param value The value as found in the configuration file.
+func (this *HostConfig) Set(key string, value string) error {
+	switch key {
+	case "subnet":
+		_, subnet, err := net.ParseCIDR(value)
+		if err != nil || subnet.IP.To4() == nil {
+			return errors.New(fmt.Sprintf("invalid IPv4 subnet ’%s’", value))
+		}
+		this.Subnet = subnet
+	case "gateway":
+		gateway := net.ParseIP(value)
+		if gateway == nil || gateway.To4() == nil {
+			return errors.New(fmt.Sprintf("invalid IPv4 gateway ’%s’", value))
+		}
+		this.Gateway = gateway.To4()
+	case "bridge":
+		if value == "" || len(value) > 15 {
+			return errors.New(fmt.Sprintf("invalid bridge name ’%s’", value))
+		}
+		this.Bridge = value
+	case "subnet6":
+		_, subnet, err := net.ParseCIDR(value)
+		if err != nil || subnet.IP.To4() != nil {
+			return errors.New(fmt.Sprintf("invalid IPv6 prefix ’%s’", value))
+		}
+		this.Subnet6 = subnet
+	case "gateway6":
+		gateway := net.ParseIP(value)
+		if gateway == nil || gateway.To4() != nil {
+			return errors.New(fmt.Sprintf("invalid IPv6 gateway ’%s’", value))
+		}
+		this.Gateway6 = gateway
+	case "dhcp_hosts", "dhcp_pid_file", "subuid_file", "subgid_file":
+		if !path.IsAbs(value) {
+			return errors.New(fmt.Sprintf("invalid %s ’%s’: expected an absolute pathname", key, value))
+		}
+		switch key {
+		case "dhcp_hosts":
+			this.Dhcp_hosts = value
+		case "dhcp_pid_file":
+			this.Dhcp_pid_file = value
+		case "subuid_file":
+			this.Subuid_file = value
+		default:
+			this.Subgid_file = value
+		}
+	case "subid_user":
+		if value == "" || strings.ContainsAny(value, ": \t") {
+			return errors.New(fmt.Sprintf("invalid subid_user ’%s’", value))
+		}
+		this.Subid_user = value
+	case "capacity_memory":
+		memory, err := ParseByteSize(value)
+		if err != nil || memory < 0 {
+			return errors.New(fmt.Sprintf("invalid capacity_memory ’%s’", value))
+		}
+		this.Capacity_memory = memory
+	case "capacity_cpus":
+		cpus, err := ParseCpus(value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid capacity_cpus ’%s’", value))
+		}
+		this.Capacity_cpus = cpus
+	case "memory_overcommit", "cpu_overcommit":
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratio <= 0 {
+			return errors.New(fmt.Sprintf("invalid %s ’%s’: expected a positive ratio", key, value))
+		}
+		if key == "memory_overcommit" {
+			this.Memory_overcommit = ratio
+		} else {
+			this.Cpu_overcommit = ratio
+		}
+	case "admission":
+		if value != "refuse" && value != "warn" && value != "off" {
+			return errors.New(fmt.Sprintf("invalid admission ’%s’: expected refuse, warn, or off", value))
+		}
+		this.Admission = value
+	case "nameserver":
+		nameserver := net.ParseIP(value)
+		if nameserver == nil {
+			return errors.New(fmt.Sprintf("invalid name server ’%s’", value))
+		}
+		this.Nameservers = append(this.Nameservers, nameserver)
+	default:
+		return errors.New(fmt.Sprintf("unknown configuration key ’%s’", key))
+	}
+	return nil
+}
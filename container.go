@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
@@ -42,7 +43,8 @@ type Container struct {
 	image_set *ImageSet;
 	
 	/* The cgroup configuration of this container. A default map
-	   is provided.*/
+	   is provided. Its lxc.network.* keys are ignored; network
+	   blocks are rendered from Spec.Networks instead.*/
 	Cgroup_info CgroupInfo;
 	
 	/* The soft resource limits for the container.
@@ -53,6 +55,10 @@ type Container struct {
 	/* The hard resource limits for the container.
 	   nil by default. */
 	Hard_limits *ResourceLimits;
+	
+	/* The persistent specification of the container, stored in
+	   <cdir>/meta/spec. */
+	Spec *ContainerSpec;
 }
 
 // Creates a new container object from the default cache.
@@ -75,6 +81,7 @@ func NewContainerFromDefaultCache(container_name string, containers_path string)
 		GetDefaultCgroupInfo(container_name, rootfs, fstab),
 		nil,
 		nil,
+		NewDefaultContainerSpec(),
 	};
 }
 
@@ -102,6 +109,7 @@ et) *Container {
 		GetDefaultCgroupInfo(container_name, rootfs, fstab),
 		nil,
 		nil,
+		NewDefaultContainerSpec(),
 	}
 }
 
@@ -139,6 +147,10 @@ r container ’%s’", container_name))
 		return nil, err
 	}
 	var image_set *ImageSet = NewImageSet(string(image_set_name), path.Dir(string(image_set_dir)))
+	spec, err3 := LoadContainerSpec(path.Join(container_dir, "meta"))
+	if err3 != nil {
+		return nil, err3
+	}
 	var rootfs = path.Join(container_dir, "rootfs")
 	var fstab = path.Join(container_dir, "fstab")
 	return &Container{container_name,
@@ -152,9 +164,38 @@ r container ’%s’", container_name))
 		GetDefaultCgroupInfo(container_name, rootfs, fstab),
 		nil,
 		nil,
+		spec,
 	}, err
 }
 
+// Returns the containers found under a containers path. Directories that
+// do not hold a container’s meta-data are skipped.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+func ListContainers(containers_path string) ([]*Container, error) {
+	containers := make([]*Container, 0)
+	entries, err := ioutil.ReadDir(containers_path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !FileExists(path.Join(containers_path, entry.Name(), "meta/image-set-name")) {
+			continue
+		}
+		container, err := NewContainerFromImageSetMeta(entry.Name(), containers_path)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// Returns the name of the container.
+func (this *Container) GetName() string {
+	return this.name
+}
+
 // Prepares the files, directories, configurations necessary to run
 // a container. The container’s root filesystem is mounted using AUFS.
 func (this *Container) Create() error {
@@ -173,6 +214,9 @@ func (this *Container) Create() error {
 			return errors.New(fmt.Sprintf("directory %s where OS cache is stored does not exist - cannot proceed.", DEFAULT_LXC_CACHE_PATH))
 		}
 	}
+	if err := this.CheckCreateAdmission(); err != nil {
+		return err
+	}
 	os.Mkdir(this.cdir, 755)
 	os.Mkdir(this.rootfs, 755)
 	os.Mkdir(this.meta_dir, 755)
@@ -185,14 +229,39 @@ func (this *Container) Create() error {
 		ioutil.WriteFile(image_set_dir_meta_filename, []byte(this.image_set.idir), 444
 		)
 	}
+	return this.MountAndConfigure()
+}
+
+// Mounts the container’s root filesystem and writes its specification,
+// LXC configuration, fstab, and network configuration. This is the last
+// step of preparing a container whose directories already exist.
+func (this *Container) MountAndConfigure() error {
+	if err := this.AllocateAddress(); err != nil {
+		return err
+	}
+	if err := this.AssignNetworkIdentifiers(); err != nil {
+		return err
+	}
+	owner_map, err := this.AllocateIdMap()
+	if err != nil {
+		return err
+	}
 	if err := this.Mount(); err != nil {
 		return err
-	} else {
-		this.WriteConfig()
-		this.WriteFstab()
-		this.WriteNetworkConfiguration()
 	}
-	return nil
+	for _, write := range []func() error{this.WriteSpec, this.WriteConfig, this.WriteFstab,
+		this.WriteNetworkConfiguration, this.WriteFirewallConfiguration} {
+		if err := write(); err != nil {
+			return err
+		}
+	}
+	if err := this.ShiftPrivateData(owner_map); err != nil {
+		return err
+	}
+	if err := UpdateDHCPHosts(this.GetContainersPath()); err != nil {
+		return err
+	}
+	return UpdateGroupHosts(this.GetContainersPath(), this.Spec.Group)
 }
 
 /// Returns the home directory of a user.
@@ -227,8 +296,26 @@ func (this *Container) AdvancedStart(blocked_start bool) error {
 	if this.IsRunning() {
 		return errors.New("container " + this.name + " is already running - cannot start")
 	}
-	root_fifo := NewFIFOCommandForUser(path.Join(this.rootfs, "/root/.cmd"), this.rootfs, 0, 0)
-	web_fifo := NewFIFOCommandForUser(path.Join(this.rootfs, "/home/web/.cmd"), this.rootfs, 1000, 1000)
+	// Hold the admission lock until lxc-start has returned so that the
+	// container counts as running for the next check.
+	admission_lock, err := LockAdmission(this.GetContainersPath())
+	if err != nil {
+		return err
+	}
+	defer admission_lock.Close()
+	if err := this.CheckAdmission(this.Spec.Resources.GetReservation()); err != nil {
+		return err
+	}
+	if err := this.WriteFirewallConfiguration(); err != nil {
+		return err
+	}
+	if err := this.ShiftWrittenFiles(); err != nil {
+		return err
+	}
+	root_uid, root_gid, _ := this.GetHostIds("root")
+	web_uid, web_gid, _ := this.GetHostIds("web")
+	root_fifo := NewFIFOCommandForUser(path.Join(this.rootfs, "/root/.cmd"), this.rootfs, root_uid, root_gid)
+	web_fifo := NewFIFOCommandForUser(path.Join(this.rootfs, "/home/web/.cmd"), this.rootfs, web_uid, web_gid)
 	if root_fifo.FileExists() {
 		os.Remove(root_fifo.Filename)
 	}
@@ -237,17 +324,30 @@ func (this *Container) AdvancedStart(blocked_start bool) error {
 		os.Remove(web_fifo.Filename)
 	}
 	web_fifo.Create()
+	if err := this.ResetTrafficBaseline(); err != nil {
+		return err
+	}
 	cmd := exec.Command("lxc-start", "-n", this.name, "-d", "-f", path.Join(this.cdir, "config"))
 	var bout bytes.Buffer
 	var berr bytes.Buffer
 	cmd.Stdout = &bout
 	cmd.Stderr = &berr
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "stdout> %s\n", bout.String())
 		fmt.Fprintf(os.Stderr, "stderr> %s\n", berr.String())
 		return err
 	}
+	admission_lock.Close()
+	err = this.InstallPortForwarding()
+	if err != nil {
+		// None of the container’s ports are forwarded, but it runs.
+		return errors.New(fmt.Sprintf("container ’%s’ is running but its ports are not forwarded: %s", this.name, err))
+	}
+	err = this.InstallRateLimits()
+	if err != nil {
+		return err
+	}
 	if blocked_start {
 		root_err := root_fifo.WaitUntilServerIsAlive()
 		if root_err != nil {
@@ -268,6 +368,10 @@ func (this *Container) AdvancedStart(blocked_start bool) error {
 
 /// Stops the container.
 func (this *Container) Stop() error {
+	// The counters vanish with the veth pair and the forwarding rules.
+	if _, err := this.CollectTraffic(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot collect the traffic of %s: %s\n", this.name, err)
+	}
 	cmd := exec.Command("lxc-stop", "-n", this.name)
 	var bout bytes.Buffer
 	var berr bytes.Buffer
@@ -281,6 +385,9 @@ func (this *Container) Stop() error {
 	} else {
 		fmt.Fprintf(os.Stderr, "stopping %s was successful!\n", this.name)
 	}
+	this.RemovePortForwarding()
+	this.RemoveRateLimits()
+	this.ResetTrafficBaseline()
 	fmt.Fprintf(os.Stderr, "remounting %s\n", this.name)
 	this.Remount()
 	return nil
@@ -328,6 +435,83 @@ func (this *Container) Delete() error {
 	if rm_cdir_err != nil {
 		return rm_cdir_err
 	}
+	
+	// Finally, give the container’s address back to the subnet and drop
+	// it from the /etc/hosts of its group.
+	err := ReleaseAddress(this.GetContainersPath(), this.name)
+	if err == nil {
+		err = ReleaseIPv6Address(this.GetContainersPath(), this.name)
+	}
+	if err == nil {
+		err = UpdateDHCPHosts(this.GetContainersPath())
+	}
+	if err != nil {
+		return err
+	}
+	// Rebalance the containers sharing CPUs with this one. The container
+	// is gone by now, so a failure is only reported.
+	changed, err := ReleaseCpus(this.GetContainersPath(), this.name)
+	if err == nil {
+		err = ApplyCpuAllocations(this.GetContainersPath(), changed)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot rebalance CPUs after deleting ’%s’: %s\n", this.name, err)
+	}
+	return UpdateGroupHosts(this.GetContainersPath(), this.Spec.Group)
+}
+
+// Returns the path of the containers this container lives in (e.g. "/web").
+func (this *Container) GetContainersPath() string {
+	return path.Dir(this.cdir)
+}
+
+// Leases a static IPv4 address (and an IPv6 address if an IPv6 prefix is
+// configured) to this container from the configured subnets and records
+// them in the container’s specification. A container keeps its leases
+// until it is deleted; a restored container is given its previous
+// addresses back when they are still free. A container without an
+// addressable interface (network mode none or host) gives up its leases.
+func (this *Container) AllocateAddress() error {
+	if GetPrimaryInterfaceIndex(this.Spec.Networks) == -1 {
+		this.Spec.Ipv4 = ""
+		this.Spec.Ipv4_gateway = ""
+		this.Spec.Ipv6 = ""
+		this.Spec.Ipv6_gateway = ""
+		err := ReleaseAddress(this.GetContainersPath(), this.name)
+		if err != nil {
+			return err
+		}
+		return ReleaseIPv6Address(this.GetContainersPath(), this.name)
+	}
+	config, err := GetHostConfig()
+	if err != nil {
+		return err
+	}
+	var preferred net.IP = nil
+	if this.Spec.Ipv4 != "" {
+		preferred, _, _ = net.ParseCIDR(this.Spec.Ipv4)
+	}
+	address, err := AllocateAddress(this.GetContainersPath(), this.name, config, preferred)
+	if err != nil {
+		return err
+	}
+	this.Spec.Ipv4 = GetAddressWithPrefix(address, config.Subnet)
+	this.Spec.Ipv4_gateway = config.Gateway.String()
+	if config.Subnet6 == nil {
+		this.Spec.Ipv6 = ""
+		this.Spec.Ipv6_gateway = ""
+		return ReleaseIPv6Address(this.GetContainersPath(), this.name)
+	}
+	preferred = nil
+	if this.Spec.Ipv6 != "" {
+		preferred, _, _ = net.ParseCIDR(this.Spec.Ipv6)
+	}
+	address, err = AllocateIPv6Address(this.GetContainersPath(), this.name, config, preferred)
+	if err != nil {
+		return err
+	}
+	this.Spec.Ipv6 = GetAddressWithPrefix(address, config.Subnet6)
+	this.Spec.Ipv6_gateway = config.Gateway6.String()
 	return nil
 }
 
@@ -372,13 +556,45 @@ func (this *Container) Unmount() error {
 	return syscall.Unmount(this.rootfs, syscall.MNT_DETACH)
 }
 
+// Write this container’s specification to the file <cdir>/meta/spec.
+func (this *Container) WriteSpec() error {
+	return this.Spec.Save(this.meta_dir)
+}
+
 // Write this container’s LXC configuration to the file <cdir>/config and
 // <prefix>/var/lib/lxc/cname/config
 func (this *Container) WriteConfig() error {
-	var configuration_bytes, err = GetCgroupInfoBytes(this.Cgroup_info)
+	config, err := GetHostConfig()
+	if err != nil {
+		return err
+	}
+	info, err := this.Spec.Capabilities.ApplyTo(this.Spec.Devices.ApplyTo(WithoutNetworkKeys(this.Cgroup_info)))
+	if err != nil {
+		return err
+	}
+	info, err = this.WriteSeccompPolicy(this.ApplyIdMap(info))
+	if err != nil {
+		return err
+	}
+	// Containers without a cpuset run on the CPUs not held exclusively.
+	resources := this.Spec.Resources
+	if resources.Cpuset == "" {
+		if resources.Cpuset, err = GetSharedCpuset(this.GetContainersPath()); err != nil {
+			return err
+		}
+	}
+	configuration_bytes, err := GetCgroupInfoBytesWithResources(info, &resources)
 	if err != nil {
 		return err
 	}	
+	network_bytes, err := this.GetNetworkConfigBytes(config)
+	if err != nil {
+		return err
+	}
+	configuration_bytes, err = AdaptConfigToInstalledLXC(append(configuration_bytes, network_bytes...))
+	if err != nil {
+		return err
+	}
 	err = ioutil.WriteFile(this.config_pathname, configuration_bytes, 0644)
 	if err != nil {
 		return err
@@ -474,6 +690,7 @@ func (this *Container) WriteFstab() error {
 // Write this container’s network configuration files, which include:
 // - /etc/hostname
 // - /etc/hosts
+// - /etc/network/interfaces
 // - /etc/dhcp/dhclient.conf (or) /etc/dhcp3/dhclient.conf
 func (this *Container) WriteNetworkConfiguration() error {
 	err1 := ioutil.WriteFile(path.Join(this.rootfs, "/etc/hostname"),
@@ -481,8 +698,11 @@ func (this *Container) WriteNetworkConfiguration() error {
 	if err1 != nil {
 		return err1
 	}
-	err2 := ioutil.WriteFile(path.Join(this.rootfs, "/etc/hosts"),
-		[]byte(fmt.Sprintf("127.0.0.1 localhost %s", this.name)), 644)
+	interfaces_err := this.WriteInterfaces()
+	if interfaces_err != nil {
+		return interfaces_err
+	}
+	err2 := this.WriteHosts()
 	if err2 != nil {
 		return err2
 	}
@@ -507,6 +727,21 @@ func (this *Container) WriteNetworkConfiguration() error {
 	return err3
 }
 
+// Write the container’s /etc/network/interfaces configuring its network
+// interfaces, the primary one with the static address leased to the
+// container. The image set’s interfaces file configures eth0 using DHCP.
+func (this *Container) WriteInterfaces() error {
+	config, err := GetHostConfig()
+	if err != nil {
+		return err
+	}
+	interfaces, err := this.GetInterfacesFileBytes(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(this.rootfs, "/etc/network/interfaces"), interfaces, 0644)
+}
+
 // Executes a command in the container as a daemon.
 //
 // @param user The username of the new process.
@@ -541,14 +776,11 @@ func (this *Container) ExecuteImpl(user string, args []string, blocked bool) (*F
 		return nil, errors.New(fmt.Sprintf("User %s home directory %s on container %s does not exist, full path %s", user, home_dir, this.name, home_dir_on_host))
 	}
 	cmd_file := path.Join(home_dir_on_host, ".cmd")
-	var fifo_command *FIFOCommand = nil
-	if user == "root" {
-		fifo_command = NewFIFOCommandForUser(cmd_file, this.rootfs, 0, 0)
-	} else if user == "web" {
-		fifo_command = NewFIFOCommandForUser(cmd_file, this.rootfs, 1000, 1000)
-	} else {
-		errors.New("users other than web or root are not supported.")
+	uid, gid, err := this.GetHostIds(user)
+	if err != nil {
+		return nil, err
 	}
+	fifo_command := NewFIFOCommandForUser(cmd_file, this.rootfs, uid, gid)
 	var cmd_err error = nil
 	var result *FIFOCommandResult = nil
 	if blocked {
@@ -556,6 +788,10 @@ func (this *Container) ExecuteImpl(user string, args []string, blocked bool) (*F
 	} else {
 		cmd_err = fifo_command.ExecuteDaemonOnServer(args)
 	}
+	failed := cmd_err != nil || (result != nil && result.ExitCode != 0)
+	if count_err := this.CountExecution(failed); count_err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot count the command: %s\n", count_err)
+	}
 	return result, cmd_err
 }
 
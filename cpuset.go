@@ -0,0 +1,482 @@
+/// File: cpuset.go
+/// Purpose: Allocates exclusive and shared CPU sets to containers from the
+/// host’s online CPUs and records them in a persistent allocation file.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The allocation file relative to the containers path.
+const CPUSETS_FILENAME string = ".cpusets"
+
+// The file listing the host’s online CPUs.
+const ONLINE_CPUS_PATH string = "/sys/devices/system/cpu/online"
+
+// Describes the CPUs allocated to a container.
+type CpuAllocation struct {
+
+	/* The number of CPUs requested. */
+	Count int;
+
+	/* Whether the CPUs are the container’s alone. Shared CPUs are spread
+	   over the CPUs no container holds exclusively. */
+	Exclusive bool;
+
+	/* The CPUs assigned to the container. */
+	Cpus []int;
+}
+
+// The CPU allocations of the containers under a containers path keyed by
+// container name. They are stored as JSON in <containers_path>/.cpusets
+// and updated under an exclusive lock on .cpusets.lock.
+type CpuAllocations map[string]*CpuAllocation
+
+// Parses a CPU list such as "0-3,6".
+func ParseCpuList(list string) ([]int, error) {
+	cpus := make([]int, 0)
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil || low < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid CPU list ’%s’", list))
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil || high < low {
+				return nil, errors.New(fmt.Sprintf("invalid CPU list ’%s’", list))
+			}
+		}
+		for cpu := low; cpu <= high; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// Returns CPUs as a list such as "0-3,6", ranges collapsed.
+func FormatCpuList(cpus []int) string {
+	sorted := append([]int{}, cpus...)
+	sort.Ints(sorted)
+	parts := make([]string, 0)
+	for i := 0; i < len(sorted); {
+		j := i
+		for j + 1 < len(sorted) && sorted[j + 1] == sorted[j] + 1 {
+			j++
+		}
+		if j == i {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// Returns the host’s online CPUs.
+func GetOnlineCpus() ([]int, error) {
+	list, err := ioutil.ReadFile(ONLINE_CPUS_PATH)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCpuList(string(list))
+}
+
+// Returns the container names of the allocations in sorted order.
+func (this CpuAllocations) GetSortedNames() []string {
+	names := make([]string, 0, len(this))
+	for name, _ := range this {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Assigns CPUs to every allocation. Exclusive allocations keep their
+// CPUs if they are still online and not held by another; the others take
+// the lowest free CPUs. Shared allocations are then spread over the
+// remaining CPUs, each taking the least loaded ones. Returns an error if
+// the exclusive allocations would leave no CPU for the containers without
+// one or too few for a shared allocation.
+//
+// @param online The host’s online CPUs.
+func (this CpuAllocations) Assign(online []int) error {
+	is_online := make(map[int]bool)
+	for _, cpu := range online {
+		is_online[cpu] = true
+	}
+	held := make(map[int]bool)
+	exclusive_count := 0
+	unassigned := make([]string, 0)
+	for _, name := range this.GetSortedNames() {
+		allocation := this[name]
+		if !allocation.Exclusive {
+			continue
+		}
+		exclusive_count += allocation.Count
+		keep := len(allocation.Cpus) == allocation.Count
+		for _, cpu := range allocation.Cpus {
+			if !is_online[cpu] || held[cpu] {
+				keep = false
+			}
+		}
+		if !keep {
+			unassigned = append(unassigned, name)
+			continue
+		}
+		for _, cpu := range allocation.Cpus {
+			held[cpu] = true
+		}
+	}
+	if exclusive_count >= len(online) {
+		return errors.New(fmt.Sprintf("cannot hold %d CPUs exclusively: the host has %d and one must stay shared",
+			exclusive_count, len(online)))
+	}
+	for _, name := range unassigned {
+		allocation := this[name]
+		allocation.Cpus = make([]int, 0, allocation.Count)
+		for _, cpu := range online {
+			if len(allocation.Cpus) == allocation.Count {
+				break
+			}
+			if !held[cpu] {
+				allocation.Cpus = append(allocation.Cpus, cpu)
+				held[cpu] = true
+			}
+		}
+	}
+	pool := make([]int, 0)
+	for _, cpu := range online {
+		if !held[cpu] {
+			pool = append(pool, cpu)
+		}
+	}
+	load := make(map[int]int)
+	for _, name := range this.GetSortedNames() {
+		allocation := this[name]
+		if allocation.Exclusive {
+			continue
+		}
+		if allocation.Count > len(pool) {
+			return errors.New(fmt.Sprintf("container ’%s’ shares %d CPUs but only %d are not held exclusively",
+				name, allocation.Count, len(pool)))
+		}
+		candidates := append([]int{}, pool...)
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return load[candidates[i]] < load[candidates[j]]
+		})
+		allocation.Cpus = candidates[:allocation.Count]
+		sort.Ints(allocation.Cpus)
+		for _, cpu := range allocation.Cpus {
+			load[cpu]++
+		}
+	}
+	return nil
+}
+
+// Returns the CPUs held exclusively, mapped to the names of the
+// containers holding them.
+func (this CpuAllocations) GetExclusiveCpus() map[int]string {
+	exclusive := make(map[int]string)
+	for name, allocation := range this {
+		if allocation.Exclusive {
+			for _, cpu := range allocation.Cpus {
+				exclusive[cpu] = name
+			}
+		}
+	}
+	return exclusive
+}
+
+// Returns an error if a cpuset includes CPUs another container holds
+// exclusively.
+//
+// @param cname The name of the container the cpuset is for.
+// @param cpuset The CPU list (e.g. "0-3").
+func (this CpuAllocations) CheckShared(cname string, cpuset string) error {
+	cpus, err := ParseCpuList(cpuset)
+	if err != nil {
+		return err
+	}
+	exclusive := this.GetExclusiveCpus()
+	for _, cpu := range cpus {
+		if holder := exclusive[cpu]; holder != "" && holder != cname {
+			return errors.New(fmt.Sprintf("the cpuset %s of ’%s’ includes CPU %d held exclusively by ’%s’",
+				cpuset, cname, cpu, holder))
+		}
+	}
+	return nil
+}
+
+// Returns the CPUs not held exclusively, on which containers without an
+// allocation run, or "" if no CPU is held exclusively.
+//
+// @param online The host’s online CPUs.
+func (this CpuAllocations) GetSharedCpuset(online []int) string {
+	exclusive := this.GetExclusiveCpus()
+	if len(exclusive) == 0 {
+		return ""
+	}
+	shared := make([]int, 0)
+	for _, cpu := range online {
+		if exclusive[cpu] == "" {
+			shared = append(shared, cpu)
+		}
+	}
+	return FormatCpuList(shared)
+}
+
+// Returns the pathname of the allocation file under a containers path.
+func GetCpuAllocationsPathname(containers_path string) string {
+	return path.Join(containers_path, CPUSETS_FILENAME)
+}
+
+// Reads the CPU allocations of the containers under a containers path.
+// The caller must hold the allocation lock if they are to be modified.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+func ReadCpuAllocations(containers_path string) (CpuAllocations, error) {
+	allocations := make(CpuAllocations)
+	allocations_bytes, err := ioutil.ReadFile(GetCpuAllocationsPathname(containers_path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return allocations, nil
+		}
+		return nil, err
+	}
+	return allocations, json.Unmarshal(allocations_bytes, &allocations)
+}
+
+// Returns the CPUs containers without an allocation under a containers
+// path run on: those not held exclusively, or "" if no CPU is.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+func GetSharedCpuset(containers_path string) (string, error) {
+	allocations, err := ReadCpuAllocations(containers_path)
+	if err != nil || len(allocations.GetExclusiveCpus()) == 0 {
+		return "", err
+	}
+	online, err := GetOnlineCpus()
+	if err != nil {
+		return "", err
+	}
+	return allocations.GetSharedCpuset(online), nil
+}
+
+// Changes the CPU allocations of the containers under a containers path
+// and reassigns every allocation’s CPUs. Nothing is saved if the update
+// or the assignment fails, or if a container pinned by hand (with
+// ’set-resources --cpuset’) would run on CPUs held exclusively. Returns
+// the CPU lists of the containers whose CPUs changed, keyed by container
+// name ("" if released). Containers without an allocation or a cpuset
+// are included with "" when the CPUs not held exclusively change, since
+// they run on those.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param update Changes the allocations.
+func UpdateCpuAllocations(containers_path string, update func(allocations CpuAllocations) error) (map[string]string, error) {
+	lock, err := LockFile(GetCpuAllocationsPathname(containers_path) + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	allocations, err := ReadCpuAllocations(containers_path)
+	if err != nil {
+		return nil, err
+	}
+	online, err := GetOnlineCpus()
+	if err != nil {
+		return nil, err
+	}
+	before := make(map[string]string)
+	for name, allocation := range allocations {
+		before[name] = FormatCpuList(allocation.Cpus)
+	}
+	before_shared := allocations.GetSharedCpuset(online)
+	if err = update(allocations); err != nil {
+		return nil, err
+	}
+	if err = allocations.Assign(online); err != nil {
+		return nil, err
+	}
+	containers, err := ListContainers(containers_path)
+	if err != nil {
+		return nil, err
+	}
+	unpinned := make([]string, 0)
+	for _, container := range containers {
+		if allocations[container.name] != nil {
+			continue
+		} else if cpuset := container.Spec.Resources.Cpuset; cpuset != "" {
+			if err = allocations.CheckShared(container.name, cpuset); err != nil {
+				return nil, errors.New(fmt.Sprintf("%s; allocate its CPUs with ’qb cpus’ instead", err))
+			}
+		} else {
+			unpinned = append(unpinned, container.name)
+		}
+	}
+	allocations_bytes, err := json.MarshalIndent(allocations, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	err = WriteFileAtomically(GetCpuAllocationsPathname(containers_path), allocations_bytes, 0644)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]string)
+	for name, _ := range before {
+		if allocations[name] == nil {
+			changed[name] = ""
+		}
+	}
+	for name, allocation := range allocations {
+		if cpus := FormatCpuList(allocation.Cpus); cpus != before[name] {
+			changed[name] = cpus
+		}
+	}
+	if allocations.GetSharedCpuset(online) != before_shared {
+		for _, name := range unpinned {
+			changed[name] = ""
+		}
+	}
+	return changed, nil
+}
+
+// Allocates CPUs to a container, replacing its previous allocation.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param cname The name of the container.
+// @param count The number of CPUs.
+// @param exclusive Whether no other container may use the CPUs.
+func AllocateCpus(containers_path string, cname string, count int, exclusive bool) (map[string]string, error) {
+	if count < 1 {
+		return nil, errors.New(fmt.Sprintf("invalid CPU count %d", count))
+	}
+	return UpdateCpuAllocations(containers_path, func(allocations CpuAllocations) error {
+		previous := allocations[cname]
+		if previous != nil && previous.Exclusive == exclusive && previous.Count == count {
+			return nil
+		}
+		allocations[cname] = &CpuAllocation{count, exclusive, []int{}}
+		return nil
+	})
+}
+
+// Releases the CPUs allocated to a container, if any, and rebalances the
+// shared allocations.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param cname The name of the container.
+func ReleaseCpus(containers_path string, cname string) (map[string]string, error) {
+	return UpdateCpuAllocations(containers_path, func(allocations CpuAllocations) error {
+		delete(allocations, cname)
+		return nil
+	})
+}
+
+// Sets the CPUs of the containers whose allocations changed, updating
+// running containers immediately. Containers that no longer exist are
+// skipped.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param changed The CPU lists keyed by container name.
+func ApplyCpuAllocations(containers_path string, changed map[string]string) error {
+	var first_err error = nil
+	for _, name := range GetSortedKeysOfStrings(changed) {
+		container, err := NewContainerFromImageSetMeta(name, containers_path)
+		if err == nil && container.IsCreated() {
+			err = container.SetCpuset(changed[name])
+		} else {
+			err = nil
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "container ’%s’: %s\n", name, err)
+			if first_err == nil {
+				first_err = err
+			}
+		}
+	}
+	return first_err
+}
+
+// Returns the keys of a map of strings in sorted order.
+func GetSortedKeysOfStrings(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key, _ := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns a copy of resources to apply to the running container, its
+// cpuset set to the CPUs it runs on if it has none: the CPUs not held
+// exclusively, or all online CPUs, since a cpuset cannot be removed from
+// a running cgroup.
+//
+// @param resources The container’s resources.
+func (this *Container) GetLiveResources(resources *Resources) (Resources, error) {
+	live_resources := *resources
+	if live_resources.Cpuset != "" {
+		return live_resources, nil
+	}
+	shared, err := GetSharedCpuset(this.GetContainersPath())
+	if err != nil {
+		return live_resources, err
+	}
+	if shared == "" {
+		online, err := GetOnlineCpus()
+		if err != nil {
+			return live_resources, err
+		}
+		shared = FormatCpuList(online)
+	}
+	live_resources.Cpuset = shared
+	return live_resources, nil
+}
+
+// Sets the CPUs the container may run on, rewriting its configuration
+// and applying the change if it is running.
+//
+// @param cpuset The CPU list (e.g. "0-3"), or "" for the CPUs not held
+// exclusively.
+func (this *Container) SetCpuset(cpuset string) error {
+	old_resources := this.Spec.Resources
+	this.Spec.Resources.Cpuset = cpuset
+	if err := this.WriteConfig(); err != nil {
+		this.Spec.Resources = old_resources
+		return err
+	}
+	if err := this.WriteSpec(); err != nil {
+		return err
+	}
+	if _, pid_err := this.GetInitPid(); pid_err != nil && !this.IsRunning() {
+		return nil
+	}
+	live_resources, err := this.GetLiveResources(&this.Spec.Resources)
+	if err != nil {
+		return err
+	}
+	rejected, err := this.ApplyResourcesLive(&old_resources, &live_resources)
+	if err != nil {
+		return err
+	}
+	if len(rejected) > 0 {
+		return errors.New(fmt.Sprintf("the kernel rejected %s = %s: %s", rejected[0].File, rejected[0].Value, rejected[0].Err))
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+/// File: devices.go
+/// Purpose: Describes the devices a container may use as a named policy
+/// rendered into the devices cgroup settings of its LXC configuration.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Describes devices a container may access.
+type DeviceRule struct {
+
+	/* The name the rule was added by (e.g. "fuse" or "/dev/kvm"), or ""
+	   for a rule given by its numbers. */
+	Name string;
+
+	/* "c" for character devices, "b" for block devices, or "a" for all. */
+	Type string;
+
+	/* The major and minor numbers, or -1 to match any. */
+	Major int;
+	Minor int;
+
+	/* Any combination of "r" (read), "w" (write), and "m" (mknod). */
+	Access string;
+}
+
+// Describes the devices of a container. All devices are denied except
+// those allowed by a rule.
+type DevicePolicy struct {
+
+	/* The preset the policy was created from, or "" for none. */
+	Preset string;
+
+	/* The devices the container may access. */
+	Allow []DeviceRule;
+}
+
+// The devices that may be allowed by name.
+var named_devices = map[string][]DeviceRule{
+	"mknod":     {{"mknod", "c", -1, -1, "m"}, {"mknod", "b", -1, -1, "m"}},
+	"null":      {{"null", "c", 1, 3, "rwm"}},
+	"zero":      {{"zero", "c", 1, 5, "rwm"}},
+	"full":      {{"full", "c", 1, 7, "rwm"}},
+	"random":    {{"random", "c", 1, 8, "rwm"}},
+	"urandom":   {{"urandom", "c", 1, 9, "rwm"}},
+	"tty":       {{"tty", "c", 5, 0, "rwm"}},
+	"console":   {{"console", "c", 5, 1, "rwm"}},
+	"ptmx":      {{"ptmx", "c", 5, 2, "rwm"}},
+	"tty0":      {{"tty0", "c", 4, 0, "rwm"}},
+	"tty1":      {{"tty1", "c", 4, 1, "rwm"}},
+	"pts":       {{"pts", "c", 136, -1, "rwm"}},
+	"rtc":       {{"rtc", "c", 254, 0, "rwm"}},
+	"tun":       {{"tun", "c", 10, 200, "rwm"}},
+	"fuse":      {{"fuse", "c", 10, 229, "rwm"}},
+	"kvm":       {{"kvm", "c", 10, 232, "rwm"}},
+	"vhost-net": {{"vhost-net", "c", 10, 238, "rwm"}},
+}
+
+// The named devices allowed by each preset, in the order they are
+// rendered.
+var device_presets = map[string][]string{
+	// Any mknod (but not using the node), /dev/null and zero, consoles,
+	// /dev/{,u}random, ptys, rtc, fuse, and tun.
+	"default": {"mknod", "null", "zero", "console", "tty", "tty0", "tty1", "urandom",
+		"random", "pts", "ptmx", "rtc", "fuse", "tun"},
+	"minimal": {"null", "zero", "full", "random", "urandom", "tty", "console", "ptmx", "pts"},
+	"virtualization": {"mknod", "null", "zero", "console", "tty", "tty0", "tty1", "urandom",
+		"random", "pts", "ptmx", "rtc", "fuse", "tun", "kvm", "vhost-net"},
+}
+
+// Returns the names of the device presets in sorted order.
+func GetDevicePresetNames() []string {
+	names := make([]string, 0, len(device_presets))
+	for name, _ := range device_presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the device policy of a preset.
+//
+// @param preset The name of the preset (e.g. "default").
+func NewDevicePolicy(preset string) (DevicePolicy, error) {
+	names, ok := device_presets[preset]
+	if !ok {
+		return DevicePolicy{}, errors.New(fmt.Sprintf("invalid device preset ’%s’: expected one of %s",
+			preset, strings.Join(GetDevicePresetNames(), ", ")))
+	}
+	policy := DevicePolicy{preset, []DeviceRule{}}
+	for _, name := range names {
+		policy.Allow = append(policy.Allow, named_devices[name]...)
+	}
+	return policy, nil
+}
+
+// Returns the default device policy, which allows the devices the
+// image sets have always been given.
+func NewDefaultDevicePolicy() DevicePolicy {
+	policy, _ := NewDevicePolicy("default")
+	return policy
+}
+
+// Returns a device number as a string, or "*" for any.
+func FormatDeviceNumber(number int) string {
+	if number < 0 {
+		return "*"
+	}
+	return strconv.Itoa(number)
+}
+
+// Returns the rule in the ’TYPE MAJOR:MINOR ACCESS’ form of the devices
+// cgroup (e.g. "c 10:229 rwm").
+func (this DeviceRule) String() string {
+	if this.Type == "a" {
+		return "a *:* " + this.Access
+	}
+	return fmt.Sprintf("%s %s:%s %s", this.Type, FormatDeviceNumber(this.Major),
+		FormatDeviceNumber(this.Minor), this.Access)
+}
+
+// Returns true iff two rules match the same devices.
+func (this DeviceRule) SameDevices(other DeviceRule) bool {
+	return this.Type == other.Type && this.Major == other.Major && this.Minor == other.Minor
+}
+
+// Parses a device number, which is "*" for any.
+func ParseDeviceNumber(number string) (int, error) {
+	if number == "*" {
+		return -1, nil
+	}
+	result, err := strconv.Atoi(number)
+	if err != nil || result < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid device number ’%s’", number))
+	}
+	return result, nil
+}
+
+// Parses a rule of the form ’TYPE MAJOR:MINOR [ACCESS]’ (e.g. "c 10:232"
+// or "b 7:* rw"). The access defaults to "rwm".
+func ParseDeviceRule(rule string) (DeviceRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 || len(fields) > 3 {
+		return DeviceRule{}, errors.New(fmt.Sprintf("invalid device rule ’%s’: expected TYPE MAJOR:MINOR [ACCESS]", rule))
+	}
+	result := DeviceRule{"", fields[0], -1, -1, "rwm"}
+	if len(fields) == 3 {
+		result.Access = fields[2]
+	}
+	numbers := strings.Split(fields[1], ":")
+	if len(numbers) != 2 {
+		return DeviceRule{}, errors.New(fmt.Sprintf("invalid device numbers ’%s’: expected MAJOR:MINOR", fields[1]))
+	}
+	var err error
+	if result.Major, err = ParseDeviceNumber(numbers[0]); err != nil {
+		return DeviceRule{}, err
+	}
+	if result.Minor, err = ParseDeviceNumber(numbers[1]); err != nil {
+		return DeviceRule{}, err
+	}
+	return result, result.Validate()
+}
+
+// Returns nil iff the rule is well-formed.
+func (this DeviceRule) Validate() error {
+	if this.Type != "c" && this.Type != "b" && this.Type != "a" {
+		return errors.New(fmt.Sprintf("invalid device type ’%s’: expected c, b, or a", this.Type))
+	}
+	if this.Access == "" || strings.Trim(this.Access, "rwm") != "" {
+		return errors.New(fmt.Sprintf("invalid device access ’%s’: expected a combination of r, w, and m", this.Access))
+	}
+	return nil
+}
+
+// Returns the major and minor numbers of a device given the st_rdev of
+// its node, using the encoding of the Linux kernel.
+func GetDeviceNumbers(rdev uint64) (int, int) {
+	major := ((rdev >> 8) & 0xfff) | ((rdev >> 32) & 0xfffff000)
+	minor := (rdev & 0xff) | ((rdev >> 12) & 0xffffff00)
+	return int(major), int(minor)
+}
+
+// Returns the rule allowing the device node at a host pathname.
+//
+// @param pathname The pathname of the device node (e.g. "/dev/kvm").
+func GetDeviceRuleFromNode(pathname string) (DeviceRule, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(pathname, &stat); err != nil {
+		return DeviceRule{}, errors.New(fmt.Sprintf("cannot stat device ’%s’: %s", pathname, err))
+	}
+	device_type := ""
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		device_type = "c"
+	case syscall.S_IFBLK:
+		device_type = "b"
+	default:
+		return DeviceRule{}, errors.New(fmt.Sprintf("’%s’ is not a device node", pathname))
+	}
+	major, minor := GetDeviceNumbers(uint64(stat.Rdev))
+	return DeviceRule{pathname, device_type, major, minor, "rwm"}, nil
+}
+
+// Returns the rules a device is allowed by. The device is a name (e.g.
+// "fuse"), the pathname of a host device node (e.g. "/dev/kvm"), or a
+// rule (e.g. "c 10:232 rwm").
+func ResolveDevice(device string) ([]DeviceRule, error) {
+	if rules, ok := named_devices[device]; ok {
+		return rules, nil
+	}
+	if strings.HasPrefix(device, "/") {
+		rule, err := GetDeviceRuleFromNode(device)
+		if err != nil {
+			return nil, err
+		}
+		return []DeviceRule{rule}, nil
+	}
+	if strings.Contains(device, " ") {
+		rule, err := ParseDeviceRule(device)
+		if err != nil {
+			return nil, err
+		}
+		return []DeviceRule{rule}, nil
+	}
+	names := make([]string, 0, len(named_devices))
+	for name, _ := range named_devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, errors.New(fmt.Sprintf("unknown device ’%s’: expected a device node, a rule, or one of %s",
+		device, strings.Join(names, ", ")))
+}
+
+// Allows the container to access a device.
+//
+// @param device A device name, host device node, or rule (see
+// ResolveDevice).
+func (this *DevicePolicy) AllowDevice(device string) error {
+	rules, err := ResolveDevice(device)
+	if err != nil {
+		return err
+	}
+	added := false
+	for _, rule := range rules {
+		if this.Allows(rule) {
+			continue
+		}
+		this.Allow = append(this.Allow, rule)
+		added = true
+	}
+	if !added {
+		return errors.New(fmt.Sprintf("device ’%s’ is already allowed", device))
+	}
+	return nil
+}
+
+// Removes the rules allowing a device.
+//
+// @param device A device name, host device node, or rule (see
+// ResolveDevice).
+func (this *DevicePolicy) DenyDevice(device string) error {
+	rules, err := ResolveDevice(device)
+	if err != nil {
+		return err
+	}
+	kept := make([]DeviceRule, 0, len(this.Allow))
+	for _, existing := range this.Allow {
+		denied := false
+		for _, rule := range rules {
+			if existing.SameDevices(rule) {
+				denied = true
+			}
+		}
+		if !denied {
+			kept = append(kept, existing)
+		}
+	}
+	if len(kept) == len(this.Allow) {
+		return errors.New(fmt.Sprintf("device ’%s’ is not allowed", device))
+	}
+	this.Allow = kept
+	return nil
+}
+
+// Returns true iff a rule allowing the same devices with the same
+// access exists.
+func (this *DevicePolicy) Allows(rule DeviceRule) bool {
+	for _, existing := range this.Allow {
+		if existing.SameDevices(rule) && existing.Access == rule.Access {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the allowed devices in the form of the devices cgroup.
+func (this *DevicePolicy) GetAllowStrings() []string {
+	allow := make([]string, 0, len(this.Allow))
+	for _, rule := range this.Allow {
+		allow = append(allow, rule.String())
+	}
+	return allow
+}
+
+// Returns a copy of an LXC configuration with the devices cgroup keys
+// set to the policy. Translating to cgroup v2 moves the keys to
+// lxc.cgroup2.devices.
+func (this *DevicePolicy) ApplyTo(info CgroupInfo) CgroupInfo {
+	result := make(CgroupInfo)
+	for key, values := range info {
+		result[key] = values
+	}
+	result["lxc.cgroup.devices.deny"] = []string{"a"}
+	result["lxc.cgroup.devices.allow"] = this.GetAllowStrings()
+	return result
+}
@@ -0,0 +1,95 @@
+/// File: dhcp.go
+/// Purpose: Writes a dnsmasq dhcp-hostsfile mapping each container’s MAC
+/// address to its leased address and name, so a host-side DHCP server
+/// hands out the same addresses qb leases.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The default pathname of the DHCP hosts file.
+const DEFAULT_DHCP_HOSTS_PATH string = "/var/lib/quickbuddy/dhcp-hosts"
+
+// Returns the DHCP hosts file of a set of containers: one
+// ’MAC,ADDRESS,NAME’ line per container with a leased address, in the
+// format of dnsmasq’s --dhcp-hostsfile.
+func GetDHCPHostsFileBytes(containers []*Container) []byte {
+	lines := make([]string, 0)
+	for _, container := range containers {
+		primary := GetPrimaryInterfaceIndex(container.Spec.Networks)
+		if primary == -1 || container.Spec.Ipv4 == "" {
+			continue
+		}
+		hwaddr := container.Spec.Networks[primary].Hwaddr
+		address, _, err := net.ParseCIDR(container.Spec.Ipv4)
+		if hwaddr == "" || err != nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s,%s,%s", hwaddr, address, container.name))
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// Rewrites the DHCP hosts file from the containers under a containers
+// path and, if a DHCP server pid file is configured, asks the server to
+// reread it. Called whenever a container is created, deleted, or its
+// network changes.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+func UpdateDHCPHosts(containers_path string) error {
+	config, err := GetHostConfig()
+	if err != nil {
+		return err
+	}
+	lock, err := LockFile(path.Join(containers_path, ".dhcp-hosts.lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	containers, err := ListContainers(containers_path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Dir(config.Dhcp_hosts), 0755)
+	if err != nil {
+		return err
+	}
+	err = WriteFileAtomically(config.Dhcp_hosts, GetDHCPHostsFileBytes(containers), 0644)
+	if err != nil || config.Dhcp_pid_file == "" {
+		return err
+	}
+	return SignalDHCPServer(config.Dhcp_pid_file)
+}
+
+// Sends SIGHUP to the DHCP server whose pid is stored in a file, which
+// makes dnsmasq reread its hosts files. Nothing is done if the server is
+// not running.
+func SignalDHCPServer(pid_file string) error {
+	pid_bytes, err := ioutil.ReadFile(pid_file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pid_bytes)))
+	if err != nil {
+		return err
+	}
+	err = syscall.Kill(pid, syscall.SIGHUP)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+/// File: events.go
+/// Purpose: Records events of a container (e.g. OOM kills) in a log kept
+/// in its meta directory, which subscribers follow with ’qb events’.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+)
+
+// The number of most recent events kept in a container’s event log.
+const MAX_EVENT_LOG_LENGTH int = 1000
+
+// Describes an event of a container.
+type ContainerEvent struct {
+
+	/* The number of the event, which increases by one with each event
+	   recorded for the container. */
+	Sequence uint64;
+
+	/* The time of the event in seconds since the epoch. */
+	Time int64;
+
+	/* The name of the container. */
+	Container string;
+
+	/* The kind of the event (e.g. "oom"). */
+	Type string;
+
+	/* A human readable description of the event. */
+	Detail string;
+}
+
+// Returns the pathname of the container’s event log, which holds one
+// JSON encoded event per line.
+func (this *Container) GetEventLogPathname() string {
+	return path.Join(this.meta_dir, "events")
+}
+
+// Reads the events in the container’s event log, oldest first.
+func (this *Container) ReadEvents() ([]ContainerEvent, error) {
+	events := make([]ContainerEvent, 0)
+	file, err := os.Open(this.GetEventLogPathname())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return events, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event ContainerEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// Records an event in the container’s event log. Only the most recent
+// MAX_EVENT_LOG_LENGTH events are kept.
+//
+// @param event_type The kind of the event (e.g. "oom").
+// @param detail A human readable description of the event.
+func (this *Container) RecordEvent(event_type string, detail string) (*ContainerEvent, error) {
+	lock, err := LockFile(this.GetEventLogPathname() + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	events, err := this.ReadEvents()
+	if err != nil {
+		return nil, err
+	}
+	var sequence uint64 = 1
+	if len(events) > 0 {
+		sequence = events[len(events) - 1].Sequence + 1
+	}
+	event := ContainerEvent{sequence, time.Now().Unix(), this.name, event_type, detail}
+	events = append(events, event)
+	if len(events) > MAX_EVENT_LOG_LENGTH {
+		events = events[len(events) - MAX_EVENT_LOG_LENGTH:]
+	}
+	log_bytes := make([]byte, 0)
+	for _, logged := range events {
+		event_bytes, err := json.Marshal(logged)
+		if err != nil {
+			return nil, err
+		}
+		log_bytes = append(log_bytes, event_bytes...)
+		log_bytes = append(log_bytes, '\n')
+	}
+	return &event, WriteFileAtomically(this.GetEventLogPathname(), log_bytes, 0644)
+}
+
+// Returns the events of the container recorded after an event.
+//
+// @param sequence The sequence number of the last event seen (0 for all).
+func (this *Container) ReadEventsAfter(sequence uint64) ([]ContainerEvent, error) {
+	events, err := this.ReadEvents()
+	if err != nil {
+		return nil, err
+	}
+	after := make([]ContainerEvent, 0)
+	for _, event := range events {
+		if event.Sequence > sequence {
+			after = append(after, event)
+		}
+	}
+	return after, nil
+}
@@ -0,0 +1,311 @@
+/// File: firewall.go
+/// Purpose: Renders a container’s declarative firewall policy into the
+/// iptables-restore and ip6tables-restore files loaded by the container’s
+/// /etc/rc.local.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Describes inbound traffic a container accepts.
+type FirewallRule struct {
+
+	/* One of "tcp", "udp", "icmp", or "all". */
+	Proto string;
+
+	/* The destination port or port range (e.g. "8080" or "6000:6010"),
+	   or "" for all ports. Only allowed for tcp and udp. */
+	Port string;
+
+	/* The source address or subnet (e.g. "10.0.3.0/24"), or "" for any. */
+	Source string;
+}
+
+// Describes the firewall of a container. Loopback traffic and traffic
+// belonging to established connections are always accepted.
+type FirewallPolicy struct {
+
+	/* The policy for inbound traffic not matching a rule: ACCEPT or DROP. */
+	Inbound_policy string;
+
+	/* The policy for outbound traffic: ACCEPT or DROP. */
+	Outbound_policy string;
+
+	/* The inbound traffic to accept. */
+	Inbound []FirewallRule;
+}
+
+// Returns the default firewall policy, which like the image sets’
+// original iptables configuration accepts all inbound traffic, listing
+// TCP port 8080 so that it stays open if the policy is set to DROP.
+func NewDefaultFirewallPolicy() FirewallPolicy {
+	return FirewallPolicy{"ACCEPT", "ACCEPT", []FirewallRule{{"tcp", "8080", ""}}}
+}
+
+// Parses a rule of the form PORT/PROTO (e.g. "8080/tcp", "6000:6010/udp"),
+// PROTO (e.g. "icmp"), or PORT (TCP is assumed).
+//
+// @param rule The rule to parse.
+// @param source The source address or subnet, or "" for any.
+func ParseFirewallRule(rule string, source string) (FirewallRule, error) {
+	port, proto := rule, "tcp"
+	if slash := strings.Index(rule, "/"); slash != -1 {
+		port, proto = rule[:slash], rule[slash+1:]
+	} else if _, err := strconv.Atoi(strings.Split(rule, ":")[0]); err != nil {
+		port, proto = "", rule
+	}
+	result := FirewallRule{strings.ToLower(proto), port, source}
+	return result, result.Validate()
+}
+
+// Returns nil iff the rule is well-formed.
+func (this FirewallRule) Validate() error {
+	switch this.Proto {
+	case "tcp", "udp":
+	case "icmp", "all":
+		if this.Port != "" {
+			return errors.New(fmt.Sprintf("protocol ’%s’ does not have ports", this.Proto))
+		}
+	default:
+		return errors.New(fmt.Sprintf("invalid protocol ’%s’: expected tcp, udp, icmp, or all", this.Proto))
+	}
+	if this.Port != "" {
+		bounds := strings.Split(this.Port, ":")
+		if len(bounds) > 2 {
+			return errors.New(fmt.Sprintf("invalid port range ’%s’", this.Port))
+		}
+		for _, bound := range bounds {
+			port, err := strconv.Atoi(bound)
+			if err != nil || port < 1 || port > 65535 {
+				return errors.New(fmt.Sprintf("invalid port ’%s’", bound))
+			}
+		}
+	}
+	if this.Source != "" && net.ParseIP(this.Source) == nil {
+		if _, _, err := net.ParseCIDR(this.Source); err != nil {
+			return errors.New(fmt.Sprintf("invalid source address ’%s’", this.Source))
+		}
+	}
+	return nil
+}
+
+// Returns the rule in the PORT/PROTO form accepted by ParseFirewallRule
+// followed by its source (if any).
+func (this FirewallRule) String() string {
+	rule := this.Proto
+	if this.Port != "" {
+		rule = this.Port + "/" + this.Proto
+	}
+	if this.Source != "" {
+		rule += " from " + this.Source
+	}
+	return rule
+}
+
+// Returns true iff the rule applies to a family of addresses: rules
+// without a source apply to both IPv4 and IPv6.
+//
+// @param ipv6 Whether the family is IPv6.
+func (this FirewallRule) AppliesTo(ipv6 bool) bool {
+	if this.Source == "" {
+		return true
+	}
+	source := net.ParseIP(this.Source)
+	if source == nil {
+		source, _, _ = net.ParseCIDR(this.Source)
+	}
+	return source != nil && (source.To4() == nil) == ipv6
+}
+
+// Returns the iptables arguments matching a rule.
+func (this FirewallRule) GetMatchArguments() string {
+	arguments := ""
+	if this.Source != "" {
+		arguments += " -s " + this.Source
+	}
+	if this.Proto != "all" {
+		arguments += " -p " + this.Proto
+	}
+	if this.Port != "" {
+		arguments += fmt.Sprintf(" -m %s --dport %s", this.Proto, this.Port)
+	}
+	return arguments
+}
+
+// Returns nil iff the policy is well-formed.
+func (this *FirewallPolicy) Validate() error {
+	for _, policy := range []string{this.Inbound_policy, this.Outbound_policy} {
+		if policy != "ACCEPT" && policy != "DROP" {
+			return errors.New(fmt.Sprintf("invalid firewall policy ’%s’: expected ACCEPT or DROP", policy))
+		}
+	}
+	for _, rule := range this.Inbound {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true iff the policy accepts inbound traffic to a port from any
+// source.
+//
+// @param proto Either "tcp" or "udp".
+// @param port The destination port.
+func (this *FirewallPolicy) AllowsPort(proto string, port int) bool {
+	if this.Inbound_policy == "ACCEPT" {
+		return true
+	}
+	for _, rule := range this.Inbound {
+		if rule.Source != "" || (rule.Proto != proto && rule.Proto != "all") {
+			continue
+		}
+		if rule.Port == "" {
+			return true
+		}
+		bounds := strings.Split(rule.Port, ":")
+		low, _ := strconv.Atoi(bounds[0])
+		high := low
+		if len(bounds) == 2 {
+			high, _ = strconv.Atoi(bounds[1])
+		}
+		if port >= low && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a rule unless an identical rule exists. Returns true iff it was added.
+func (this *FirewallPolicy) Allow(rule FirewallRule) bool {
+	for _, existing := range this.Inbound {
+		if existing == rule {
+			return false
+		}
+	}
+	this.Inbound = append(this.Inbound, rule)
+	return true
+}
+
+// Removes a rule. Returns true iff the rule existed.
+func (this *FirewallPolicy) Deny(rule FirewallRule) bool {
+	for i, existing := range this.Inbound {
+		if existing == rule {
+			this.Inbound = append(this.Inbound[:i], this.Inbound[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an iptables-restore file implementing a firewall policy.
+//
+// @param policy The firewall policy.
+// @param dhcp Whether the container configures its address using DHCP,
+// in which case DHCP traffic is always allowed.
+func GetIPTablesConfiguration(policy *FirewallPolicy, dhcp bool) []byte {
+	lines := []string{"*filter",
+		fmt.Sprintf(":INPUT %s [0:0]", policy.Inbound_policy),
+		":FORWARD ACCEPT [0:0]",
+		fmt.Sprintf(":OUTPUT %s [0:0]", policy.Outbound_policy),
+		"-A INPUT -i lo -j ACCEPT",
+		"-A INPUT -m state --state ESTABLISHED,RELATED -j ACCEPT"}
+	if dhcp {
+		lines = append(lines, "-A INPUT -p udp -m udp --sport 67 --dport 68 -j ACCEPT")
+	}
+	for _, rule := range policy.Inbound {
+		if rule.AppliesTo(false) {
+			lines = append(lines, "-A INPUT"+rule.GetMatchArguments()+" -j ACCEPT")
+		}
+	}
+	if policy.Outbound_policy != "ACCEPT" {
+		lines = append(lines, "-A OUTPUT -o lo -j ACCEPT",
+			"-A OUTPUT -m state --state ESTABLISHED,RELATED -j ACCEPT")
+		if dhcp {
+			lines = append(lines, "-A OUTPUT -p udp -m udp --sport 68 --dport 67 -j ACCEPT")
+		}
+	}
+	lines = append(lines, "COMMIT",
+		"*nat",
+		":PREROUTING ACCEPT [0:0]",
+		":INPUT ACCEPT [0:0]",
+		":OUTPUT ACCEPT [0:0]",
+		":POSTROUTING ACCEPT [0:0]",
+		"COMMIT",
+		"")
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Returns an ip6tables-restore file implementing a firewall policy. ICMPv6
+// is always accepted since neighbor discovery depends on it, which also
+// covers rules for protocol icmp.
+//
+// @param policy The firewall policy.
+func GetIP6TablesConfiguration(policy *FirewallPolicy) []byte {
+	lines := []string{"*filter",
+		fmt.Sprintf(":INPUT %s [0:0]", policy.Inbound_policy),
+		":FORWARD ACCEPT [0:0]",
+		fmt.Sprintf(":OUTPUT %s [0:0]", policy.Outbound_policy),
+		"-A INPUT -i lo -j ACCEPT",
+		"-A INPUT -m state --state ESTABLISHED,RELATED -j ACCEPT",
+		"-A INPUT -p ipv6-icmp -j ACCEPT"}
+	for _, rule := range policy.Inbound {
+		if rule.AppliesTo(true) && rule.Proto != "icmp" {
+			lines = append(lines, "-A INPUT"+rule.GetMatchArguments()+" -j ACCEPT")
+		}
+	}
+	if policy.Outbound_policy != "ACCEPT" {
+		lines = append(lines, "-A OUTPUT -o lo -j ACCEPT",
+			"-A OUTPUT -m state --state ESTABLISHED,RELATED -j ACCEPT",
+			"-A OUTPUT -p ipv6-icmp -j ACCEPT")
+	}
+	lines = append(lines, "COMMIT", "")
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Writes the container’s firewall policy into /root/iptables.conf and
+// /root/ip6tables.conf, which /etc/rc.local loads when the container boots.
+func (this *Container) WriteFirewallConfiguration() error {
+	policy := &this.Spec.Firewall
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	err := ioutil.WriteFile(path.Join(this.rootfs, "/root/iptables.conf"),
+		GetIPTablesConfiguration(policy, this.Spec.Ipv4 == ""), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(this.rootfs, "/root/ip6tables.conf"),
+		GetIP6TablesConfiguration(policy), 0600)
+}
+
+// Rewrites the container’s firewall configuration and, if the container
+// is running, loads it using the root command server.
+func (this *Container) ApplyFirewall() error {
+	err := this.WriteFirewallConfiguration()
+	if err != nil || !this.IsRunning() {
+		return err
+	}
+	restore_commands := []string{"/sbin/iptables-restore < /root/iptables.conf"}
+	if this.Spec.Ipv6 != "" {
+		restore_commands = append(restore_commands, "/sbin/ip6tables-restore < /root/ip6tables.conf")
+	}
+	for _, restore_command := range restore_commands {
+		result, err := this.ExecuteBlocked("root", []string{"/bin/sh", "-c", restore_command})
+		if err != nil {
+			return err
+		}
+		if result.ExitCode != 0 {
+			return errors.New(fmt.Sprintf("’%s’ failed in container ’%s’ (exit %d): %s", restore_command, this.name, result.ExitCode, result.Err))
+		}
+	}
+	return nil
+}
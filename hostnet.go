@@ -0,0 +1,249 @@
+/// File: hostnet.go
+/// Purpose: Sets up and tears down the host side of the container network:
+/// the bridge, its gateway address, IP forwarding, and masquerading.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The comment identifying the host iptables rules installed by net-setup.
+const HOST_NETWORK_COMMENT string = "qb:net"
+
+// The file recording that net-setup enabled IP forwarding, relative to
+// the containers path, so that net-teardown only disables forwarding that
+// qb enabled.
+const IP_FORWARD_MARKER string = ".ip-forward-enabled"
+
+// The file recording the bridge net-setup created, relative to the
+// containers path, so that net-teardown does not delete a bridge it did
+// not create.
+const BRIDGE_MARKER string = ".bridge-created"
+
+// The file recording the gateway address net-setup assigned to a bridge
+// it did not create, relative to the containers path.
+const GATEWAY_MARKER string = ".gateway-assigned"
+
+// Describes one operation on the host network.
+type HostNetworkStep struct {
+
+	/* What the step does. */
+	Description string;
+
+	/* The command performing the step. */
+	Command []string;
+}
+
+// Returns the host iptables rules of the container network: masquerading
+// of traffic leaving the subnet and acceptance of forwarded traffic to and
+// from the bridge. Each rule has the form of GetPortMappingRules.
+func GetHostNetworkRules(config *HostConfig) [][]string {
+	subnet := config.Subnet.String()
+	return [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-d", subnet,
+			"-m", "comment", "--comment", HOST_NETWORK_COMMENT, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", config.Bridge,
+			"-m", "comment", "--comment", HOST_NETWORK_COMMENT, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", config.Bridge,
+			"-m", "comment", "--comment", HOST_NETWORK_COMMENT, "-j", "ACCEPT"},
+	}
+}
+
+// Returns the arguments of an iptables invocation performing an action
+// (-A, -C, or -D) on a rule returned by GetHostNetworkRules.
+func GetIPTablesArguments(action string, rule []string) []string {
+	return append([]string{"iptables", rule[0], rule[1], action}, rule[2:]...)
+}
+
+// Returns true iff the host iptables rule exists.
+func HasIPTablesRule(rule []string) bool {
+	args := GetIPTablesArguments("-C", rule)
+	return exec.Command(args[0], args[1:]...).Run() == nil
+}
+
+// Returns true iff a network interface exists on the host.
+func HostInterfaceExists(iface string) bool {
+	return DirExists(path.Join("/sys/class/net", iface))
+}
+
+// Returns true iff a network interface exists on the host and is up.
+func IsHostInterfaceUp(iface string) bool {
+	flags_bytes, err := ioutil.ReadFile(path.Join("/sys/class/net", iface, "flags"))
+	if err != nil {
+		return false
+	}
+	flags, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(flags_bytes)), "0x"), 16, 32)
+	// IFF_UP is 0x1.
+	return err == nil && flags&1 != 0
+}
+
+// Returns true iff an interface has an address (e.g. "10.0.3.1/24").
+func HostInterfaceHasAddress(iface string, address string) bool {
+	out, err := exec.Command("ip", "-o", "addr", "show", "dev", iface).Output()
+	if err != nil {
+		return false
+	}
+	for _, field := range strings.Fields(string(out)) {
+		if field == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true iff the host forwards IPv4 packets.
+func IsIPForwardingEnabled() bool {
+	forward_bytes, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	return err == nil && strings.TrimSpace(string(forward_bytes)) == "1"
+}
+
+// Returns the steps still needed to set up the host network. Steps that
+// have already been performed are omitted, so running them is idempotent.
+func GetNetworkSetupSteps(config *HostConfig) []HostNetworkStep {
+	steps := make([]HostNetworkStep, 0)
+	bridge := config.Bridge
+	prefix_len, _ := config.Subnet.Mask.Size()
+	gateway := fmt.Sprintf("%s/%d", config.Gateway, prefix_len)
+	if !HostInterfaceExists(bridge) {
+		steps = append(steps, HostNetworkStep{"create bridge " + bridge,
+			[]string{"ip", "link", "add", "name", bridge, "type", "bridge"}})
+	}
+	if !HostInterfaceExists(bridge) || !HostInterfaceHasAddress(bridge, gateway) {
+		steps = append(steps, HostNetworkStep{"assign gateway address " + gateway,
+			[]string{"ip", "addr", "add", gateway, "dev", bridge}})
+	}
+	if !IsHostInterfaceUp(bridge) {
+		steps = append(steps, HostNetworkStep{"bring up bridge " + bridge,
+			[]string{"ip", "link", "set", "dev", bridge, "up"}})
+	}
+	if !IsIPForwardingEnabled() {
+		steps = append(steps, HostNetworkStep{"enable IPv4 forwarding",
+			[]string{"sysctl", "-w", "net.ipv4.ip_forward=1"}})
+	}
+	for _, rule := range GetHostNetworkRules(config) {
+		if !HasIPTablesRule(rule) {
+			steps = append(steps, HostNetworkStep{"add " + rule[2] + " rule",
+				GetIPTablesArguments("-A", rule)})
+		}
+	}
+	return steps
+}
+
+// Returns the content of a marker file under the containers path, or ""
+// if it does not exist.
+func ReadNetworkMarker(containers_path string, marker string) string {
+	content, err := ioutil.ReadFile(path.Join(containers_path, marker))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// Returns the steps needed to tear down the host network set up by
+// GetNetworkSetupSteps. Only what net-setup did is undone: the bridge is
+// deleted only if net-setup created it, and otherwise only the gateway
+// address net-setup assigned to it is removed.
+//
+// @param config The host configuration.
+// @param containers_path The path of the containers (e.g. "/web").
+func GetNetworkTeardownSteps(config *HostConfig, containers_path string) []HostNetworkStep {
+	steps := make([]HostNetworkStep, 0)
+	for _, rule := range GetHostNetworkRules(config) {
+		if HasIPTablesRule(rule) {
+			steps = append(steps, HostNetworkStep{"delete " + rule[2] + " rule",
+				GetIPTablesArguments("-D", rule)})
+		}
+	}
+	if FileExists(path.Join(containers_path, IP_FORWARD_MARKER)) {
+		steps = append(steps, HostNetworkStep{"disable IPv4 forwarding",
+			[]string{"sysctl", "-w", "net.ipv4.ip_forward=0"}})
+	}
+	if !HostInterfaceExists(config.Bridge) {
+		return steps
+	}
+	if ReadNetworkMarker(containers_path, BRIDGE_MARKER) == config.Bridge {
+		steps = append(steps, HostNetworkStep{"delete bridge " + config.Bridge,
+			[]string{"ip", "link", "del", "dev", config.Bridge}})
+	} else if gateway := ReadNetworkMarker(containers_path, GATEWAY_MARKER); gateway != "" &&
+		HostInterfaceHasAddress(config.Bridge, gateway) {
+		steps = append(steps, HostNetworkStep{"remove gateway address " + gateway,
+			[]string{"ip", "addr", "del", gateway, "dev", config.Bridge}})
+	}
+	return steps
+}
+
+// Performs (or with dry_run, only prints) host network steps.
+//
+// @param steps The steps to perform in order.
+// @param dry_run Whether to only print the steps.
+// @param out The writer to print the steps to.
+func RunHostNetworkSteps(steps []HostNetworkStep, dry_run bool, out io.Writer) error {
+	for _, step := range steps {
+		fmt.Fprintf(out, "%s: %s\n", step.Description, strings.Join(step.Command, " "))
+		if dry_run {
+			continue
+		}
+		if err := RunCommand(step.Command[0], step.Command[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets up the host network: creates the bridge, assigns it the gateway
+// address, enables IP forwarding, and masquerades traffic leaving the
+// subnet.
+//
+// @param config The host configuration.
+// @param containers_path The path of the containers (e.g. "/web").
+// @param dry_run Whether to only print the operations.
+func SetUpHostNetwork(config *HostConfig, containers_path string, dry_run bool) error {
+	forwarding := IsIPForwardingEnabled()
+	bridge_existed := HostInterfaceExists(config.Bridge)
+	prefix_len, _ := config.Subnet.Mask.Size()
+	gateway := fmt.Sprintf("%s/%d", config.Gateway, prefix_len)
+	gateway_assigned := bridge_existed && HostInterfaceHasAddress(config.Bridge, gateway)
+	err := RunHostNetworkSteps(GetNetworkSetupSteps(config), dry_run, os.Stdout)
+	if err != nil || dry_run {
+		return err
+	}
+	if !bridge_existed {
+		err = ioutil.WriteFile(path.Join(containers_path, BRIDGE_MARKER), []byte(config.Bridge+"\n"), 0644)
+	} else if !gateway_assigned {
+		err = ioutil.WriteFile(path.Join(containers_path, GATEWAY_MARKER), []byte(gateway+"\n"), 0644)
+	}
+	if err != nil || forwarding {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(containers_path, IP_FORWARD_MARKER), []byte{}, 0644)
+}
+
+// Reverses SetUpHostNetwork. IP forwarding is only disabled if it was
+// enabled by SetUpHostNetwork.
+//
+// @param config The host configuration.
+// @param containers_path The path of the containers (e.g. "/web").
+// @param dry_run Whether to only print the operations.
+func TearDownHostNetwork(config *HostConfig, containers_path string, dry_run bool) error {
+	err := RunHostNetworkSteps(GetNetworkTeardownSteps(config, containers_path), dry_run, os.Stdout)
+	if err != nil || dry_run {
+		return err
+	}
+	for _, marker := range []string{IP_FORWARD_MARKER, BRIDGE_MARKER, GATEWAY_MARKER} {
+		pathname := path.Join(containers_path, marker)
+		if FileExists(pathname) {
+			if err = os.Remove(pathname); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
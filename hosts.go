@@ -0,0 +1,112 @@
+/// File: hosts.go
+/// Purpose: Writes containers’ /etc/hosts so that containers in the same
+/// group can reach each other by name.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"regexp"
+)
+
+// Matches valid group names.
+var group_pattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// Returns nil iff a group name is "" (no group) or valid.
+func ValidateGroupName(group string) error {
+	if group != "" && !group_pattern.MatchString(group) {
+		return errors.New(fmt.Sprintf("invalid group name ’%s’: expected letters, numbers, dashes, or underscores", group))
+	}
+	return nil
+}
+
+// Returns the containers of a group, or none if the group is "".
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param group The name of the group.
+func GetGroupMembers(containers_path string, group string) ([]*Container, error) {
+	members := make([]*Container, 0)
+	if group == "" {
+		return members, nil
+	}
+	containers, err := ListContainers(containers_path)
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		if container.Spec.Group == group {
+			members = append(members, container)
+		}
+	}
+	return members, nil
+}
+
+// Returns the contents of /etc/hosts for a container: localhost and the
+// container’s own name, followed by the name and static address of every
+// other member of its group. Members using DHCP are omitted since their
+// addresses are not known in advance.
+//
+// @param cname The name of the container.
+// @param group The group of the container, or "" for none.
+// @param members The members of the group.
+func GetHostsFileBytes(cname string, group string, members []*Container) []byte {
+	hosts := fmt.Sprintf("127.0.0.1 localhost %s\n", cname)
+	if group == "" {
+		return []byte(hosts)
+	}
+	hosts += fmt.Sprintf("# Members of group ’%s’, written by qb.\n", group)
+	for _, member := range members {
+		if member.name == cname || member.Spec.Ipv4 == "" {
+			continue
+		}
+		address, _, err := net.ParseCIDR(member.Spec.Ipv4)
+		if err != nil {
+			continue
+		}
+		hosts += fmt.Sprintf("%s %s\n", address, member.name)
+	}
+	return []byte(hosts)
+}
+
+// Writes the container’s /etc/hosts.
+func (this *Container) WriteHosts() error {
+	members, err := GetGroupMembers(this.GetContainersPath(), this.Spec.Group)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(this.rootfs, "/etc/hosts"),
+		GetHostsFileBytes(this.name, this.Spec.Group, members), 0644)
+}
+
+// Rewrites /etc/hosts of every mounted member of a group. Called whenever
+// a container joins or leaves a group, including when it is created or
+// deleted. Unmounted members are rewritten when they are next configured.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param group The name of the group, or "" for none.
+func UpdateGroupHosts(containers_path string, group string) error {
+	lock, err := LockFile(path.Join(containers_path, ".hosts.lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	members, err := GetGroupMembers(containers_path, group)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if !member.IsMounted() {
+			continue
+		}
+		err = ioutil.WriteFile(path.Join(member.rootfs, "/etc/hosts"),
+			GetHostsFileBytes(member.name, group, members), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
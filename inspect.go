@@ -0,0 +1,95 @@
+/// File: inspect.go
+/// Purpose: Describes a container’s state and specification in a human
+/// readable form for the ’inspect’ command.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Returns the state of the container: "running", "mounted", "created",
+// or "absent".
+func (this *Container) GetState() string {
+	switch {
+	case this.IsRunning():
+		return "running"
+	case this.IsMounted():
+		return "mounted"
+	case this.IsCreated():
+		return "created"
+	}
+	return "absent"
+}
+
+// Writes a description of the container to a writer, one ’field value’
+// per line.
+//
+// @param out The writer to describe the container to.
+func (this *Container) Inspect(out io.Writer) error {
+	fmt.Fprintf(out, "%-16s %s\n", "name", this.name)
+	fmt.Fprintf(out, "%-16s %s\n", "directory", this.cdir)
+	if this.image_set != nil {
+		fmt.Fprintf(out, "%-16s %s\n", "image set", this.image_set.name)
+	}
+	fmt.Fprintf(out, "%-16s %s\n", "state", this.GetState())
+	if this.Spec.Group != "" {
+		fmt.Fprintf(out, "%-16s %s\n", "group", this.Spec.Group)
+	}
+	if this.Spec.Ipv4 != "" {
+		fmt.Fprintf(out, "%-16s %s gateway %s\n", "address", this.Spec.Ipv4, this.Spec.Ipv4_gateway)
+	} else {
+		fmt.Fprintf(out, "%-16s dhcp\n", "address")
+	}
+	if this.Spec.Ipv6 != "" {
+		fmt.Fprintf(out, "%-16s %s gateway %s\n", "address6", this.Spec.Ipv6, this.Spec.Ipv6_gateway)
+	}
+	for _, iface := range this.Spec.Networks {
+		fmt.Fprintf(out, "%-16s %s", "interface", iface.Name)
+		fmt.Fprintf(out, " mode=%s", iface.Mode)
+		if iface.Hwaddr != "" {
+			fmt.Fprintf(out, " hwaddr=%s", iface.Hwaddr)
+		}
+		if iface.Veth_pair != "" {
+			fmt.Fprintf(out, " veth-pair=%s", iface.Veth_pair)
+		}
+		fmt.Fprintf(out, "\n")
+	}
+	for _, mapping := range this.Spec.Ports {
+		fmt.Fprintf(out, "%-16s %s\n", "port", mapping)
+	}
+	fmt.Fprintf(out, "%-16s %s\n", "bandwidth", this.Spec.Bandwidth)
+	for _, setting := range this.Spec.Resources.GetSettingStrings() {
+		fmt.Fprintf(out, "%-16s %s\n", "resource", setting)
+	}
+	capabilities := &this.Spec.Capabilities
+	fmt.Fprintf(out, "%-16s %s\n", "cap profile", capabilities.Name)
+	if len(capabilities.Keep) == 0 {
+		fmt.Fprintf(out, "%-16s %s\n", "cap dropped", strings.Join(capabilities.Drop, " "))
+	}
+	fmt.Fprintf(out, "%-16s %s\n", "cap effective", strings.Join(capabilities.GetEffectiveCapabilities(), " "))
+	fmt.Fprintf(out, "%-16s %s\n", "seccomp", this.Spec.Seccomp.String())
+	fmt.Fprintf(out, "%-16s %s\n", "userns", this.Spec.Userns)
+	events, err := this.ReadEvents()
+	if err != nil {
+		return err
+	}
+	ooms := make([]ContainerEvent, 0)
+	for _, event := range events {
+		if event.Type == "oom" {
+			ooms = append(ooms, event)
+		}
+	}
+	fmt.Fprintf(out, "%-16s %d\n", "oom events", len(ooms))
+	// Only the most recent OOM events are listed; ’qb events’ shows all.
+	if len(ooms) > 5 {
+		ooms = ooms[len(ooms) - 5:]
+	}
+	for _, event := range ooms {
+		fmt.Fprintf(out, "%-16s %s %s\n", "oom", time.Unix(event.Time, 0).Format("2006-01-02 15:04:05"), event.Detail)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+/// File: ipam.go
+/// Purpose: Allocates stable IPv4 and IPv6 addresses to containers from the
+/// configured subnets and records them in persistent lease files.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The lease files of IPv4 and IPv6 addresses relative to the containers
+// path.
+const IPV4_LEASES_FILENAME string = ".leases"
+const IPV6_LEASES_FILENAME string = ".leases6"
+
+// Encapsulates the address leases of the containers under a containers
+// path. Leases are stored in <containers_path>/.leases (IPv6 leases in
+// .leases6), one ’cname address’ per line, and updated under an exclusive
+// lock on .leases.lock.
+type AddressLeases struct {
+
+	/* The pathname of the lease file. */
+	pathname string;
+
+	/* The leased addresses keyed by container name. */
+	leases map[string]net.IP;
+}
+
+// Returns the nth address of a subnet (0 is the network address). IPv4
+// addresses are returned in their 4-byte form.
+func GetNthAddress(subnet *net.IPNet, n uint32) net.IP {
+	base := subnet.IP.To4()
+	if base == nil {
+		base = subnet.IP.To16()
+	}
+	address := make(net.IP, len(base))
+	copy(address, base)
+	low := binary.BigEndian.Uint32(address[len(address)-4:])
+	binary.BigEndian.PutUint32(address[len(address)-4:], low+n)
+	return address
+}
+
+// Returns the number of addresses in a subnet, or 2^32-1 if it has more.
+func GetSubnetSize(subnet *net.IPNet) uint32 {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones >= 32 {
+		return 0xffffffff
+	}
+	return uint32(1) << uint(bits-ones)
+}
+
+// Returns an address with its prefix length, e.g. "10.0.3.5/24".
+func GetAddressWithPrefix(address net.IP, subnet *net.IPNet) string {
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", address, ones)
+}
+
+// Reads the IPv4 address leases of the containers under a containers path.
+// The caller must hold the lease lock if the leases are to be modified.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+func ReadAddressLeases(containers_path string) (*AddressLeases, error) {
+	return ReadLeaseFile(path.Join(containers_path, IPV4_LEASES_FILENAME))
+}
+
+// Reads the IPv6 address leases of the containers under a containers path.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+func ReadIPv6AddressLeases(containers_path string) (*AddressLeases, error) {
+	return ReadLeaseFile(path.Join(containers_path, IPV6_LEASES_FILENAME))
+}
+
+// Reads the address leases from a lease file.
+//
+// @param pathname The pathname of the lease file.
+func ReadLeaseFile(pathname string) (*AddressLeases, error) {
+	leases := &AddressLeases{pathname, make(map[string]net.IP)}
+	if !FileExists(leases.pathname) {
+		return leases, nil
+	}
+	lease_bytes, err := ioutil.ReadFile(leases.pathname)
+	if err != nil {
+		return nil, err
+	}
+	for line_no, line := range strings.Split(string(lease_bytes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || net.ParseIP(fields[1]) == nil {
+			return nil, errors.New(fmt.Sprintf("%s line %d: corrupt lease ’%s’", leases.pathname, line_no+1, line))
+		}
+		leases.leases[fields[0]] = net.ParseIP(fields[1])
+	}
+	return leases, nil
+}
+
+// Writes the leases back to the lease file.
+func (this *AddressLeases) Write() error {
+	cnames := make([]string, 0, len(this.leases))
+	for cname, _ := range this.leases {
+		cnames = append(cnames, cname)
+	}
+	sort.Strings(cnames)
+	buffer := make([]byte, 0)
+	for _, cname := range cnames {
+		buffer = append(buffer, []byte(fmt.Sprintf("%s %s\n", cname, this.leases[cname]))...)
+	}
+	return WriteFileAtomically(this.pathname, buffer, 0644)
+}
+
+// Returns the address leased to a container or nil if it has none.
+func (this *AddressLeases) Lookup(cname string) net.IP {
+	return this.leases[cname]
+}
+
+// Returns the container names mapped to their leased addresses.
+func (this *AddressLeases) GetAll() map[string]net.IP {
+	return this.leases
+}
+
+// Returns the address leased to a container, leasing one if it has none.
+// The network, gateway, and (last) broadcast addresses are never leased.
+//
+// @param cname The name of the container.
+// @param subnet The subnet to lease from.
+// @param gateway The gateway of the subnet.
+// @param preferred An address to lease if it is free, or nil.
+func (this *AddressLeases) Allocate(cname string, subnet *net.IPNet, gateway net.IP, preferred net.IP) (net.IP, error) {
+	if address := this.leases[cname]; address != nil && subnet.Contains(address) {
+		return address, nil
+	}
+	used := make(map[string]bool)
+	for _, address := range this.leases {
+		used[address.String()] = true
+	}
+	used[gateway.String()] = true
+	size := GetSubnetSize(subnet)
+	if preferred != nil && subnet.Contains(preferred) && !used[preferred.String()] &&
+		!preferred.Equal(GetNthAddress(subnet, 0)) && !preferred.Equal(GetNthAddress(subnet, size-1)) {
+		if preferred.To4() != nil {
+			preferred = preferred.To4()
+		}
+		this.leases[cname] = preferred
+		return this.leases[cname], nil
+	}
+	for n := uint32(1); n+1 < size; n++ {
+		address := GetNthAddress(subnet, n)
+		if !used[address.String()] {
+			this.leases[cname] = address
+			return address, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no free addresses left in subnet %s", subnet))
+}
+
+// Releases the address leased to a container (if any).
+func (this *AddressLeases) Release(cname string) {
+	delete(this.leases, cname)
+}
+
+// Leases an address to a container under the lease lock and records it.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param cname The name of the container.
+// @param config The host configuration holding the subnet.
+// @param preferred An address to lease if it is free, or nil.
+func AllocateAddress(containers_path string, cname string, config *HostConfig, preferred net.IP) (net.IP, error) {
+	return AllocateAddressFromFile(containers_path, IPV4_LEASES_FILENAME, cname, config.Subnet, config.Gateway, preferred)
+}
+
+// Leases an IPv6 address to a container from the configured IPv6 prefix
+// under the lease lock and records it.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param cname The name of the container.
+// @param config The host configuration holding the prefix.
+// @param preferred An address to lease if it is free, or nil.
+func AllocateIPv6Address(containers_path string, cname string, config *HostConfig, preferred net.IP) (net.IP, error) {
+	return AllocateAddressFromFile(containers_path, IPV6_LEASES_FILENAME, cname, config.Subnet6, config.Gateway6, preferred)
+}
+
+// Leases an address to a container from a subnet under the lease lock and
+// records it in a lease file.
+func AllocateAddressFromFile(containers_path string, filename string, cname string,
+	subnet *net.IPNet, gateway net.IP, preferred net.IP) (net.IP, error) {
+	lock, err := LockFile(path.Join(containers_path, ".leases.lock"))
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	leases, err := ReadLeaseFile(path.Join(containers_path, filename))
+	if err != nil {
+		return nil, err
+	}
+	if address := leases.Lookup(cname); address != nil && subnet.Contains(address) {
+		return address, nil
+	}
+	address, err := leases.Allocate(cname, subnet, gateway, preferred)
+	if err != nil {
+		return nil, err
+	}
+	return address, leases.Write()
+}
+
+// Releases the IPv4 address leased to a container under the lease lock.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param cname The name of the container.
+func ReleaseAddress(containers_path string, cname string) error {
+	return ReleaseAddressFromFile(containers_path, IPV4_LEASES_FILENAME, cname)
+}
+
+// Releases the IPv6 address leased to a container under the lease lock.
+func ReleaseIPv6Address(containers_path string, cname string) error {
+	return ReleaseAddressFromFile(containers_path, IPV6_LEASES_FILENAME, cname)
+}
+
+// Releases the address leased to a container in a lease file under the
+// lease lock.
+func ReleaseAddressFromFile(containers_path string, filename string, cname string) error {
+	lock, err := LockFile(path.Join(containers_path, ".leases.lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	leases, err := ReadLeaseFile(path.Join(containers_path, filename))
+	if err != nil {
+		return err
+	}
+	if leases.Lookup(cname) == nil {
+		return nil
+	}
+	leases.Release(cname)
+	return leases.Write()
+}
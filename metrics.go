@@ -0,0 +1,241 @@
+/// File: metrics.go
+/// Purpose: Serves metrics of every container in the Prometheus text
+/// exposition format and counts the commands executed in containers.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Counts the commands executed in a container through its command
+// servers, stored in <cdir>/meta/exec-counts.
+type ExecutionCounts struct {
+
+	/* The commands sent to a command server. */
+	Executed uint64;
+
+	/* The commands that could not be sent, or that exited with a
+	   nonzero code when waited for. */
+	Failed uint64;
+}
+
+// Describes one metric of the exposition format.
+type Metric struct {
+	Name string;
+	Help string;
+
+	/* Either "gauge" or "counter". */
+	Type string;
+}
+
+// The metrics served for each container in the order they are written.
+var container_metrics = []Metric{
+	{"qb_container_running", "Whether the container is running.", "gauge"},
+	{"qb_container_memory_usage_bytes", "The memory used by the container.", "gauge"},
+	{"qb_container_memory_limit_bytes", "The memory limit of the container (0 if unlimited).", "gauge"},
+	{"qb_container_memory_failcnt_total", "How often the container hit its memory limit.", "counter"},
+	{"qb_container_cpu_seconds_total", "The CPU time used by the container.", "counter"},
+	{"qb_container_tasks", "The number of tasks in the container.", "gauge"},
+	{"qb_container_disk_usage_bytes", "The disk space used by the container’s private data.", "gauge"},
+	{"qb_container_network_receive_bytes_total", "The bytes received by the container.", "counter"},
+	{"qb_container_network_transmit_bytes_total", "The bytes sent by the container.", "counter"},
+	{"qb_container_network_receive_packets_total", "The packets received by the container.", "counter"},
+	{"qb_container_network_transmit_packets_total", "The packets sent by the container.", "counter"},
+	{"qb_container_command_server_up", "Whether a command server of the container holds its lock.", "gauge"},
+	{"qb_container_commands_executed_total", "The commands sent to the container’s command servers.", "counter"},
+	{"qb_container_commands_failed_total", "The commands that failed to run in the container.", "counter"},
+}
+
+// Returns the pathname of the container’s execution counts.
+func (this *Container) GetExecutionCountsPathname() string {
+	return path.Join(this.meta_dir, "exec-counts")
+}
+
+// Reads the container’s execution counts, which are zero if no command
+// has been executed.
+func (this *Container) ReadExecutionCounts() (*ExecutionCounts, error) {
+	counts := &ExecutionCounts{}
+	counts_bytes, err := ioutil.ReadFile(this.GetExecutionCountsPathname())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return counts, nil
+		}
+		return nil, err
+	}
+	return counts, json.Unmarshal(counts_bytes, counts)
+}
+
+// Counts one command executed in the container.
+//
+// @param failed Whether the command failed.
+func (this *Container) CountExecution(failed bool) error {
+	lock, err := LockFile(this.GetExecutionCountsPathname() + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	counts, err := this.ReadExecutionCounts()
+	if err != nil {
+		return err
+	}
+	counts.Executed++
+	if failed {
+		counts.Failed++
+	}
+	counts_bytes, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(this.GetExecutionCountsPathname(), counts_bytes, 0644)
+}
+
+// Returns whether the command server of a user ("root" or "web") in the
+// container is alive.
+func (this *Container) IsCommandServerAlive(user string) bool {
+	cmd_file := path.Join(this.rootfs, this.GetHomeDirectory(user), ".cmd")
+	return NewFIFOCommand(cmd_file, this.rootfs).IsServerAlive()
+}
+
+// Returns the disk space used by the container’s private data, which
+// holds every file changed from its image set. Files removed during the
+// walk (e.g. temporary files of a running container) are skipped.
+func (this *Container) GetDiskUsage() (uint64, error) {
+	var usage uint64 = 0
+	err := filepath.Walk(this.private_dir, func(pathname string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			usage += uint64(stat.Blocks) * 512
+		} else {
+			usage += uint64(info.Size())
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// Returns a label value escaped for the exposition format.
+func EscapeMetricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Returns the samples of one container keyed by metric name. Each sample
+// is the label set (without braces) mapped to its value.
+func (this *Container) GetMetricSamples() (map[string]map[string]float64, error) {
+	label := fmt.Sprintf(`container="%s"`, EscapeMetricLabel(this.name))
+	samples := make(map[string]map[string]float64)
+	set := func(name string, labels string, value float64) {
+		if samples[name] == nil {
+			samples[name] = make(map[string]float64)
+		}
+		samples[name][labels] = value
+	}
+	stats, err := this.Stats()
+	if err != nil {
+		return nil, err
+	}
+	running := 0.0
+	if stats.Running {
+		running = 1
+	}
+	set("qb_container_running", label, running)
+	set("qb_container_memory_usage_bytes", label, float64(stats.Memory_usage))
+	set("qb_container_memory_limit_bytes", label, float64(stats.Memory_limit))
+	set("qb_container_memory_failcnt_total", label, float64(stats.Memory_failcnt))
+	set("qb_container_cpu_seconds_total", label, float64(stats.Cpu_usage)/1e9)
+	set("qb_container_tasks", label, float64(stats.Tasks))
+	set("qb_container_network_receive_bytes_total", label, float64(stats.Network.Rx_bytes))
+	set("qb_container_network_transmit_bytes_total", label, float64(stats.Network.Tx_bytes))
+	set("qb_container_network_receive_packets_total", label, float64(stats.Network.Rx_packets))
+	set("qb_container_network_transmit_packets_total", label, float64(stats.Network.Tx_packets))
+	usage, err := this.GetDiskUsage()
+	if err != nil {
+		return nil, err
+	}
+	set("qb_container_disk_usage_bytes", label, float64(usage))
+	for _, user := range []string{"root", "web"} {
+		alive := 0.0
+		if stats.Running && this.IsCommandServerAlive(user) {
+			alive = 1
+		}
+		set("qb_container_command_server_up", label+fmt.Sprintf(`,user="%s"`, user), alive)
+	}
+	counts, err := this.ReadExecutionCounts()
+	if err != nil {
+		return nil, err
+	}
+	set("qb_container_commands_executed_total", label, float64(counts.Executed))
+	set("qb_container_commands_failed_total", label, float64(counts.Failed))
+	return samples, nil
+}
+
+// Writes the metrics of every container under a containers path in the
+// text exposition format. Containers whose metrics cannot be read are
+// reported on standard error and left out.
+//
+// @param out The writer to write the metrics to.
+// @param containers_path The path of the containers (e.g. "/web").
+func WriteContainerMetrics(out io.Writer, containers_path string) error {
+	containers, err := ListContainers(containers_path)
+	if err != nil {
+		return err
+	}
+	all_samples := make([]map[string]map[string]float64, 0, len(containers))
+	for _, container := range containers {
+		samples, err := container.GetMetricSamples()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "metrics: container ’%s’: %s\n", container.name, err)
+			continue
+		}
+		all_samples = append(all_samples, samples)
+	}
+	for _, metric := range container_metrics {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", metric.Name, metric.Help, metric.Name, metric.Type)
+		for _, samples := range all_samples {
+			for _, labels := range GetSortedKeys(samples[metric.Name]) {
+				fmt.Fprintf(out, "%s{%s} %g\n", metric.Name, labels, samples[metric.Name][labels])
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the keys of a map of samples in sorted order.
+func GetSortedKeys(samples map[string]float64) []string {
+	keys := make([]string, 0, len(samples))
+	for key, _ := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Serves the metrics of the containers under a containers path at
+// /metrics until an error occurs.
+//
+// @param listen The address to listen on (e.g. ":9101").
+// @param containers_path The path of the containers (e.g. "/web").
+func ServeMetrics(listen string, containers_path string) error {
+	http.HandleFunc("/metrics", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WriteContainerMetrics(writer, containers_path); err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return http.ListenAndServe(listen, nil)
+}
@@ -0,0 +1,365 @@
+/// File: network.go
+/// Purpose: Describes the network interfaces of a container and renders
+/// them as ordered lxc.network.* blocks and an interfaces(5) file.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The network modes a container interface may use.
+//
+//   none     The container only has a loopback interface.
+//   host     The container shares the host’s network namespace.
+//   veth     A veth pair with the host end attached to a bridge.
+//   macvlan  A macvlan interface on a host interface.
+//   vlan     A VLAN interface on a host interface.
+var network_modes = map[string]string{
+	"none": "empty",
+	"host": "none",
+	"veth": "veth",
+	"macvlan": "macvlan",
+	"vlan": "vlan",
+}
+
+// The LXC keys that make up a network block. Blocks are rendered by
+// RenderNetworkInterface and stripped from Cgroup_info.
+const LXC_NETWORK_KEY_PREFIX string = "lxc.network."
+
+// Describes a network interface of a container.
+type NetworkInterface struct {
+
+	/* The name of the interface inside the container (e.g. "eth0"). */
+	Name string;
+
+	/* One of "none", "host", "veth", "macvlan", or "vlan". */
+	Mode string;
+
+	/* The bridge (veth) or host interface (macvlan, vlan) to attach to.
+	   A veth interface without a link is attached to the bridge in the
+	   host configuration. */
+	Link string;
+
+	/* The macvlan mode: "private", "vepa", or "bridge". */
+	Macvlan_mode string;
+
+	/* The VLAN identifier of a vlan interface. */
+	Vlan_id int;
+
+	/* The MTU of the interface, or 0 for the default. */
+	Mtu int;
+
+	/* The static IPv4 address with prefix length (e.g. "192.168.1.5/24"),
+	   or "" to use DHCP. The first addressable interface is always given
+	   the address leased to the container instead. */
+	Ipv4 string;
+
+	/* The MAC address, derived from the container and interface names
+	   by AssignNetworkIdentifiers. */
+	Hwaddr string;
+
+	/* The name of the host end of a veth pair, assigned by
+	   AssignNetworkIdentifiers. */
+	Veth_pair string;
+}
+
+// Returns the default network interfaces of a container: a single veth
+// interface named eth0 on the configured bridge.
+func NewDefaultNetworkInterfaces() []NetworkInterface {
+	return []NetworkInterface{{"eth0", "veth", "", "", 0, 0, "", "", ""}}
+}
+
+// Returns a locally administered unicast MAC address derived from a
+// container name, an interface name, and a salt used to resolve
+// collisions.
+func GetDeterministicHwaddr(cname string, iface_name string, salt int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", cname, iface_name, salt)))
+	return fmt.Sprintf("02:%02x:%02x:%02x:%02x:%02x", hash[0], hash[1], hash[2], hash[3], hash[4])
+}
+
+// Returns the name of the host end of a container’s veth pair. Names are
+// "v<cname>-<index>" when that fits in the 15 characters allowed for an
+// interface name and are otherwise derived from a hash of the container
+// name and a salt used to resolve collisions.
+func GetDeterministicVethPair(cname string, index int, salt int) string {
+	name := fmt.Sprintf("v%s-%d", cname, index)
+	if len(name) <= 15 && salt == 0 && !strings.ContainsAny(cname, "/ :.") {
+		return name
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", cname, salt)))
+	return fmt.Sprintf("vq%x-%d", hash[:4], index)
+}
+
+// Assigns a stable MAC address to every addressable interface and a
+// predictable host-side name to every veth pair of this container that
+// does not have one yet. Assigned values are checked against every other
+// container under the containers path and regenerated with a different
+// salt on collision. The caller must save the specification.
+func (this *Container) AssignNetworkIdentifiers() error {
+	containers, err := ListContainers(this.GetContainersPath())
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, other := range containers {
+		if other.name == this.name {
+			continue
+		}
+		for _, iface := range other.Spec.Networks {
+			used[iface.Hwaddr] = true
+			used[iface.Veth_pair] = true
+		}
+	}
+	for i := range this.Spec.Networks {
+		iface := &this.Spec.Networks[i]
+		if !iface.IsAddressable() {
+			iface.Hwaddr, iface.Veth_pair = "", ""
+			continue
+		}
+		if iface.Hwaddr == "" || used[iface.Hwaddr] {
+			for salt := 0; iface.Hwaddr == "" || used[iface.Hwaddr]; salt++ {
+				iface.Hwaddr = GetDeterministicHwaddr(this.name, iface.Name, salt)
+			}
+		}
+		used[iface.Hwaddr] = true
+		if iface.Mode != "veth" {
+			iface.Veth_pair = ""
+			continue
+		}
+		if iface.Veth_pair == "" || used[iface.Veth_pair] {
+			for salt := 0; iface.Veth_pair == "" || used[iface.Veth_pair]; salt++ {
+				iface.Veth_pair = GetDeterministicVethPair(this.name, i, salt)
+			}
+		}
+		used[iface.Veth_pair] = true
+	}
+	return nil
+}
+
+// Forgets the MAC addresses and veth pair names of this container so that
+// AssignNetworkIdentifiers derives new ones, e.g. after the container was
+// restored from another container’s backup.
+func (this *Container) ClearNetworkIdentifiers() {
+	for i := range this.Spec.Networks {
+		this.Spec.Networks[i].Hwaddr = ""
+		this.Spec.Networks[i].Veth_pair = ""
+	}
+}
+
+// Returns true iff the interface has an address of its own, i.e. it is not
+// a loopback-only or host-shared interface.
+func (this *NetworkInterface) IsAddressable() bool {
+	return this.Mode != "none" && this.Mode != "host"
+}
+
+// Returns nil iff the interface is well-formed.
+func (this *NetworkInterface) Validate() error {
+	if _, present := network_modes[this.Mode]; !present {
+		return errors.New(fmt.Sprintf("invalid network mode ’%s’: expected none, host, veth, macvlan, or vlan", this.Mode))
+	}
+	if !this.IsAddressable() {
+		return nil
+	}
+	if this.Name == "" || len(this.Name) > 15 || strings.ContainsAny(this.Name, "/ :") {
+		return errors.New(fmt.Sprintf("invalid interface name ’%s’", this.Name))
+	}
+	if (this.Mode == "macvlan" || this.Mode == "vlan") && this.Link == "" {
+		return errors.New(fmt.Sprintf("interface %s: %s mode requires a host interface to attach to", this.Name, this.Mode))
+	}
+	if this.Mode == "vlan" && (this.Vlan_id < 1 || this.Vlan_id > 4094) {
+		return errors.New(fmt.Sprintf("interface %s: invalid VLAN id %d", this.Name, this.Vlan_id))
+	}
+	if this.Mode != "vlan" && this.Vlan_id != 0 {
+		return errors.New(fmt.Sprintf("interface %s: a VLAN id requires vlan mode", this.Name))
+	}
+	switch this.Macvlan_mode {
+	case "":
+	case "private", "vepa", "bridge":
+		if this.Mode != "macvlan" {
+			return errors.New(fmt.Sprintf("interface %s: a macvlan mode requires macvlan mode", this.Name))
+		}
+	default:
+		return errors.New(fmt.Sprintf("interface %s: invalid macvlan mode ’%s’", this.Name, this.Macvlan_mode))
+	}
+	if this.Mtu < 0 {
+		return errors.New(fmt.Sprintf("interface %s: invalid MTU %d", this.Name, this.Mtu))
+	}
+	if this.Ipv4 != "" {
+		if _, _, err := net.ParseCIDR(this.Ipv4); err != nil {
+			return errors.New(fmt.Sprintf("interface %s: invalid address ’%s’, expected address/prefix", this.Name, this.Ipv4))
+		}
+	}
+	return nil
+}
+
+// Returns nil iff a list of interfaces is well-formed. The none and host
+// modes exclude all other interfaces.
+func ValidateNetworkInterfaces(interfaces []NetworkInterface) error {
+	names := make(map[string]bool)
+	for _, iface := range interfaces {
+		if err := iface.Validate(); err != nil {
+			return err
+		}
+		if !iface.IsAddressable() && len(interfaces) > 1 {
+			return errors.New(fmt.Sprintf("network mode ’%s’ cannot be combined with other interfaces", iface.Mode))
+		}
+		if names[iface.Name] {
+			return errors.New(fmt.Sprintf("duplicate interface name ’%s’", iface.Name))
+		}
+		names[iface.Name] = true
+	}
+	return nil
+}
+
+// Returns the index of the interface that is given the container’s leased
+// address, or -1 if no interface is addressable.
+func GetPrimaryInterfaceIndex(interfaces []NetworkInterface) int {
+	for i, iface := range interfaces {
+		if iface.IsAddressable() {
+			return i
+		}
+	}
+	return -1
+}
+
+// Renders a network interface as an LXC network block. The block starts
+// with lxc.network.type, which LXC requires to begin each interface.
+//
+// @param iface The interface to render.
+// @param bridge The bridge to use for a veth interface without a link.
+// @param ipv4 The address of the interface with prefix, or "" for none.
+// @param ipv4_gateway The gateway of the interface, or "" for none.
+// @param ipv6 The IPv6 address of the interface with prefix, or "" for none.
+// @param ipv6_gateway The IPv6 gateway of the interface, or "" for none.
+func RenderNetworkInterface(iface *NetworkInterface, bridge string, ipv4 string, ipv4_gateway string,
+	ipv6 string, ipv6_gateway string) []byte {
+	lines := []string{"lxc.network.type = " + network_modes[iface.Mode]}
+	if iface.IsAddressable() {
+		link := iface.Link
+		if link == "" {
+			link = bridge
+		}
+		lines = append(lines, "lxc.network.flags = up",
+			"lxc.network.link = "+link,
+			"lxc.network.name = "+iface.Name)
+		if iface.Hwaddr != "" {
+			lines = append(lines, "lxc.network.hwaddr = "+iface.Hwaddr)
+		}
+		if iface.Veth_pair != "" {
+			lines = append(lines, "lxc.network.veth.pair = "+iface.Veth_pair)
+		}
+		if iface.Macvlan_mode != "" {
+			lines = append(lines, "lxc.network.macvlan.mode = "+iface.Macvlan_mode)
+		}
+		if iface.Vlan_id != 0 {
+			lines = append(lines, fmt.Sprintf("lxc.network.vlan.id = %d", iface.Vlan_id))
+		}
+		if iface.Mtu != 0 {
+			lines = append(lines, fmt.Sprintf("lxc.network.mtu = %d", iface.Mtu))
+		}
+		if ipv4 == "" {
+			ipv4 = "0.0.0.0"
+		}
+		lines = append(lines, "lxc.network.ipv4 = "+ipv4)
+		if ipv4_gateway != "" {
+			lines = append(lines, "lxc.network.ipv4.gateway = "+ipv4_gateway)
+		}
+		if ipv6 != "" {
+			lines = append(lines, "lxc.network.ipv6 = "+ipv6)
+		}
+		if ipv6_gateway != "" {
+			lines = append(lines, "lxc.network.ipv6.gateway = "+ipv6_gateway)
+		}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// Returns the LXC network blocks of this container in interface order.
+//
+// @param config The host configuration holding the default bridge.
+func (this *Container) GetNetworkConfigBytes(config *HostConfig) ([]byte, error) {
+	if err := ValidateNetworkInterfaces(this.Spec.Networks); err != nil {
+		return nil, err
+	}
+	primary := GetPrimaryInterfaceIndex(this.Spec.Networks)
+	buffer := make([]byte, 0)
+	for i, iface := range this.Spec.Networks {
+		ipv4, ipv4_gateway, ipv6, ipv6_gateway := iface.Ipv4, "", "", ""
+		if i == primary {
+			ipv4, ipv4_gateway = this.Spec.Ipv4, this.Spec.Ipv4_gateway
+			ipv6, ipv6_gateway = this.Spec.Ipv6, this.Spec.Ipv6_gateway
+		}
+		buffer = append(buffer, RenderNetworkInterface(&iface, config.Bridge, ipv4, ipv4_gateway, ipv6, ipv6_gateway)...)
+	}
+	return buffer, nil
+}
+
+// Returns the container’s /etc/network/interfaces. The primary interface
+// is configured with the leased addresses; other interfaces are static
+// when given an address and use DHCP otherwise.
+//
+// @param config The host configuration holding the name servers.
+func (this *Container) GetInterfacesFileBytes(config *HostConfig) ([]byte, error) {
+	interfaces := "auto lo\niface lo inet loopback\n"
+	primary := GetPrimaryInterfaceIndex(this.Spec.Networks)
+	for i, iface := range this.Spec.Networks {
+		if !iface.IsAddressable() {
+			continue
+		}
+		ipv4, ipv4_gateway := iface.Ipv4, ""
+		if i == primary {
+			ipv4, ipv4_gateway = this.Spec.Ipv4, this.Spec.Ipv4_gateway
+		}
+		interfaces += "auto " + iface.Name + "\n"
+		if ipv4 == "" {
+			interfaces += "iface " + iface.Name + " inet dhcp\n"
+		} else {
+			address, subnet, err := net.ParseCIDR(ipv4)
+			if err != nil {
+				return nil, err
+			}
+			interfaces += fmt.Sprintf("iface %s inet static\n    address %s\n    netmask %s\n",
+				iface.Name, address, net.IP(subnet.Mask))
+			if ipv4_gateway != "" {
+				interfaces += fmt.Sprintf("    gateway %s\n", ipv4_gateway)
+			}
+			if i == primary && len(config.Nameservers) > 0 {
+				interfaces += "    dns-nameservers"
+				for _, nameserver := range config.Nameservers {
+					interfaces += " " + nameserver.String()
+				}
+				interfaces += "\n"
+			}
+		}
+		if i == primary && this.Spec.Ipv6 != "" {
+			address, subnet, err := net.ParseCIDR(this.Spec.Ipv6)
+			if err != nil {
+				return nil, err
+			}
+			prefix_len, _ := subnet.Mask.Size()
+			interfaces += fmt.Sprintf("iface %s inet6 static\n    address %s\n    netmask %d\n",
+				iface.Name, address, prefix_len)
+			if this.Spec.Ipv6_gateway != "" {
+				interfaces += fmt.Sprintf("    gateway %s\n", this.Spec.Ipv6_gateway)
+			}
+		}
+	}
+	return []byte(interfaces), nil
+}
+
+// Returns a copy of a configuration map without lxc.network.* keys, which
+// are rendered from the container specification instead.
+func WithoutNetworkKeys(info CgroupInfo) CgroupInfo {
+	result := make(CgroupInfo)
+	for key, values := range info {
+		if !strings.HasPrefix(key, LXC_NETWORK_KEY_PREFIX) {
+			result[key] = values
+		}
+	}
+	return result
+}
@@ -0,0 +1,195 @@
+/// File: oom.go
+/// Purpose: Watches the memory cgroups of running containers for OOM
+/// notifications and records them in the containers’ event logs.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reads a counter from a memory cgroup file of ’key value’ lines (e.g.
+// oom_kill in memory.events). Kernels that do not report the counter
+// yield zero.
+//
+// @param dir The memory cgroup directory.
+// @param file The file to read (e.g. "memory.oom_control").
+// @param key The key of the counter.
+func ReadMemoryCgroupCounter(dir string, file string, key string) (uint64, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, nil
+}
+
+// Records an OOM event for the container, describing how many processes
+// the kernel killed since the last notification.
+//
+// @param killed The number of processes killed.
+func (this *Container) RecordOOMEvent(killed uint64) error {
+	detail := "memory limit reached"
+	if this.Spec.Resources.Memory != 0 {
+		detail = fmt.Sprintf("memory limit %s reached", FormatByteSize(this.Spec.Resources.Memory))
+	}
+	if killed > 0 {
+		detail += fmt.Sprintf(", %d process(es) killed", killed)
+	}
+	_, err := this.RecordEvent("oom", detail)
+	return err
+}
+
+// Blocks until the container’s memory cgroup is removed (i.e. until the
+// container stops), recording an event for each OOM notification. On
+// cgroup v1 hosts, an eventfd is registered for memory.oom_control
+// through cgroup.event_control; on cgroup v2 hosts, memory.events is
+// watched with inotify.
+func (this *Container) WatchOOMEvents() error {
+	dir, err := this.GetCgroupDirectory("memory")
+	if err != nil {
+		return err
+	}
+	if GetHostCgroupVersion() == 2 {
+		return this.WatchOOMEventsV2(dir)
+	}
+	return this.WatchOOMEventsV1(dir)
+}
+
+// Implements WatchOOMEvents for a cgroup v1 memory cgroup.
+//
+// @param dir The memory cgroup directory of the container.
+func (this *Container) WatchOOMEventsV1(dir string) error {
+	oom_control, err := os.Open(path.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return err
+	}
+	defer oom_control.Close()
+	efd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return errors.New(fmt.Sprintf("cannot create an eventfd: %s", errno))
+	}
+	defer syscall.Close(int(efd))
+	event_control, err := os.OpenFile(path.Join(dir, "cgroup.event_control"), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(event_control, "%d %d", efd, oom_control.Fd())
+	event_control.Close()
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot register for OOM notifications of ’%s’: %s", this.name, err))
+	}
+	last_killed, _ := ReadMemoryCgroupCounter(dir, "memory.oom_control", "oom_kill")
+	buffer := make([]byte, 8)
+	for {
+		if _, err := syscall.Read(int(efd), buffer); err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+		// The eventfd is also signaled when the cgroup is removed.
+		if !DirExists(dir) {
+			return nil
+		}
+		killed, _ := ReadMemoryCgroupCounter(dir, "memory.oom_control", "oom_kill")
+		if err := this.RecordOOMEvent(GetCounterIncrease(killed, last_killed)); err != nil {
+			return err
+		}
+		last_killed = killed
+	}
+}
+
+// Implements WatchOOMEvents for a cgroup v2 memory cgroup.
+//
+// @param dir The cgroup directory of the container.
+func (this *Container) WatchOOMEventsV2(dir string) error {
+	events_file := path.Join(dir, "memory.events")
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if _, err = syscall.InotifyAddWatch(fd, events_file, syscall.IN_MODIFY); err != nil {
+		return errors.New(fmt.Sprintf("cannot watch ’%s’: %s", events_file, err))
+	}
+	last_ooms, err := ReadMemoryCgroupCounter(dir, "memory.events", "oom")
+	if err != nil {
+		return err
+	}
+	last_killed, _ := ReadMemoryCgroupCounter(dir, "memory.events", "oom_kill")
+	buffer := make([]byte, syscall.SizeofInotifyEvent * 16)
+	for {
+		if _, err := syscall.Read(fd, buffer); err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+		// The watch is removed (IN_IGNORED) when the cgroup is removed.
+		ooms, err := ReadMemoryCgroupCounter(dir, "memory.events", "oom")
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		killed, _ := ReadMemoryCgroupCounter(dir, "memory.events", "oom_kill")
+		// memory.events also changes when other counters (e.g. high)
+		// increase, which are not OOM events.
+		if ooms != last_ooms || killed != last_killed {
+			if err := this.RecordOOMEvent(GetCounterIncrease(killed, last_killed)); err != nil {
+				return err
+			}
+		}
+		last_ooms, last_killed = ooms, killed
+	}
+}
+
+// Watches every running container under a containers path for OOM
+// notifications until an error occurs. Containers started later are
+// picked up when the path is rescanned.
+//
+// @param containers_path The path of the containers (e.g. "/web").
+// @param interval How often to rescan for started containers.
+func WatchAllOOMEvents(containers_path string, interval time.Duration) error {
+	var mutex sync.Mutex
+	watching := make(map[string]bool)
+	for {
+		containers, err := ListContainers(containers_path)
+		if err != nil {
+			return err
+		}
+		for _, container := range containers {
+			mutex.Lock()
+			if watching[container.name] || !container.IsRunning() {
+				mutex.Unlock()
+				continue
+			}
+			watching[container.name] = true
+			mutex.Unlock()
+			go func(container *Container) {
+				if err := container.WatchOOMEvents(); err != nil {
+					fmt.Fprintf(os.Stderr, "oom-watch: container ’%s’: %s\n", container.name, err)
+				}
+				mutex.Lock()
+				delete(watching, container.name)
+				mutex.Unlock()
+			}(container)
+		}
+		time.Sleep(interval)
+	}
+}
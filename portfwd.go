@@ -0,0 +1,255 @@
+/// File: portfwd.go
+/// Purpose: Forwards host ports to containers by installing host iptables
+/// NAT rules while a container runs.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Describes a host port forwarded to a container port.
+type PortMapping struct {
+
+	/* The port on the host. */
+	Host_port int;
+
+	/* The port in the container. */
+	Container_port int;
+
+	/* Either "tcp" or "udp". */
+	Proto string;
+}
+
+// Parses a port mapping of the form HOSTPORT:CONTAINERPORT[/PROTO]
+// (e.g. "8080:80/tcp"). The protocol defaults to TCP.
+func ParsePortMapping(mapping string) (PortMapping, error) {
+	result := PortMapping{0, 0, "tcp"}
+	ports := mapping
+	if slash := strings.Index(mapping, "/"); slash != -1 {
+		ports, result.Proto = mapping[:slash], strings.ToLower(mapping[slash+1:])
+	}
+	if result.Proto != "tcp" && result.Proto != "udp" {
+		return result, errors.New(fmt.Sprintf("invalid protocol ’%s’ in port mapping ’%s’: expected tcp or udp", result.Proto, mapping))
+	}
+	bounds := strings.Split(ports, ":")
+	if len(bounds) != 2 {
+		return result, errors.New(fmt.Sprintf("invalid port mapping ’%s’: expected HOSTPORT:CONTAINERPORT[/PROTO]", mapping))
+	}
+	var err1, err2 error
+	result.Host_port, err1 = strconv.Atoi(bounds[0])
+	result.Container_port, err2 = strconv.Atoi(bounds[1])
+	if err1 != nil || err2 != nil || result.Host_port < 1 || result.Host_port > 65535 ||
+		result.Container_port < 1 || result.Container_port > 65535 {
+		return result, errors.New(fmt.Sprintf("invalid port in port mapping ’%s’", mapping))
+	}
+	return result, nil
+}
+
+// Returns the mapping in the form accepted by ParsePortMapping.
+func (this PortMapping) String() string {
+	return fmt.Sprintf("%d:%d/%s", this.Host_port, this.Container_port, this.Proto)
+}
+
+// Returns the comment identifying the host iptables rules of a container.
+func GetIPTablesComment(cname string) string {
+	return "qb:" + cname
+}
+
+// Returns the comment identifying the host FORWARD rule of a container’s
+// port mapping, whose byte counter is the traffic of that mapping.
+func GetPortMappingComment(cname string, mapping PortMapping) string {
+	return GetIPTablesComment(cname) + " " + mapping.String()
+}
+
+// Returns the host iptables rules implementing a port mapping. Each rule
+// is the argument list following the -A/-D flag. The FORWARD rule accepts
+// the forwarded traffic and counts its bytes; it matches the original
+// host port so that mappings sharing a container port count apart.
+//
+// @param cname The name of the container.
+// @param address The address of the container.
+// @param mapping The port mapping.
+func GetPortMappingRules(cname string, address net.IP, mapping PortMapping) [][]string {
+	host_port := strconv.Itoa(mapping.Host_port)
+	container_port := strconv.Itoa(mapping.Container_port)
+	destination := fmt.Sprintf("%s:%d", address, mapping.Container_port)
+	comment := GetIPTablesComment(cname)
+	return [][]string{
+		{"-t", "nat", "PREROUTING", "-p", mapping.Proto, "-m", mapping.Proto, "--dport", host_port,
+			"-m", "addrtype", "--dst-type", "LOCAL",
+			"-m", "comment", "--comment", comment, "-j", "DNAT", "--to-destination", destination},
+		{"-t", "nat", "OUTPUT", "-p", mapping.Proto, "-m", mapping.Proto, "--dport", host_port,
+			"-m", "addrtype", "--dst-type", "LOCAL",
+			"-m", "comment", "--comment", comment, "-j", "DNAT", "--to-destination", destination},
+		{"-t", "filter", "FORWARD", "-d", address.String(), "-p", mapping.Proto, "-m", mapping.Proto, "--dport", container_port,
+			"-m", "conntrack", "--ctorigdstport", host_port,
+			"-m", "comment", "--comment", GetPortMappingComment(cname, mapping), "-j", "ACCEPT"},
+	}
+}
+
+// Runs iptables to append (-A) or delete (-D) a rule produced by
+// GetPortMappingRules.
+func RunIPTablesRule(action string, rule []string) error {
+	// The table comes first and the chain follows the action.
+	args := append([]string{rule[0], rule[1], action}, rule[2:]...)
+	return RunCommand("iptables", args...)
+}
+
+// Appends host iptables rules. If one cannot be appended, the rules
+// already appended are deleted again so that none are left partly
+// installed.
+//
+// @param rules The rules produced by GetPortMappingRules.
+func InstallIPTablesRules(rules [][]string) error {
+	for i, rule := range rules {
+		if err := RunIPTablesRule("-A", rule); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if undo_err := RunIPTablesRule("-D", rules[j]); undo_err != nil {
+					fmt.Fprintf(os.Stderr, "warning: %s\n", undo_err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the address of the container that ports are forwarded to.
+func (this *Container) GetForwardingAddress() (net.IP, error) {
+	if this.Spec.Ipv4 == "" {
+		return nil, errors.New(fmt.Sprintf("container ’%s’ has no static address - cannot forward ports", this.name))
+	}
+	address, _, err := net.ParseCIDR(this.Spec.Ipv4)
+	return address, err
+}
+
+// Returns an error if a host port of a mapping is already forwarded to
+// another container under the same containers path.
+func (this *Container) CheckPortConflicts(mappings []PortMapping) error {
+	containers, err := ListContainers(this.GetContainersPath())
+	if err != nil {
+		return err
+	}
+	for _, other := range containers {
+		if other.name == this.name {
+			continue
+		}
+		for _, theirs := range other.Spec.Ports {
+			for _, ours := range mappings {
+				if theirs.Host_port == ours.Host_port && theirs.Proto == ours.Proto {
+					return errors.New(fmt.Sprintf("host port %d/%s is already forwarded to container ’%s’", ours.Host_port, ours.Proto, other.name))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Adds a port mapping to the container’s specification and, if the
+// container is running, installs its host rules. The caller must save
+// the specification.
+func (this *Container) AddPortMapping(mapping PortMapping) error {
+	for _, existing := range this.Spec.Ports {
+		if existing.Host_port == mapping.Host_port && existing.Proto == mapping.Proto {
+			return errors.New(fmt.Sprintf("host port %d/%s is already forwarded to container ’%s’", mapping.Host_port, mapping.Proto, this.name))
+		}
+	}
+	address, err := this.GetForwardingAddress()
+	if err != nil {
+		return err
+	}
+	err = this.CheckPortConflicts([]PortMapping{mapping})
+	if err != nil {
+		return err
+	}
+	if !this.Spec.Firewall.AllowsPort(mapping.Proto, mapping.Container_port) {
+		fmt.Fprintf(os.Stderr, "warning: the firewall of container ’%s’ does not allow %d/%s (see ’qb firewall’)\n",
+			this.name, mapping.Container_port, mapping.Proto)
+	}
+	if this.IsRunning() {
+		if err = InstallIPTablesRules(GetPortMappingRules(this.name, address, mapping)); err != nil {
+			return err
+		}
+	}
+	this.Spec.Ports = append(this.Spec.Ports, mapping)
+	return nil
+}
+
+// Removes a port mapping from the container’s specification and, if the
+// container is running, removes its host rules first. The specification
+// is unchanged if a rule cannot be removed. The caller must save the
+// specification.
+func (this *Container) RemovePortMapping(mapping PortMapping) error {
+	for i, existing := range this.Spec.Ports {
+		if existing != mapping {
+			continue
+		}
+		if this.IsRunning() {
+			address, err := this.GetForwardingAddress()
+			if err != nil {
+				return err
+			}
+			for _, rule := range GetPortMappingRules(this.name, address, mapping) {
+				if err = RunIPTablesRule("-D", rule); err != nil {
+					return err
+				}
+			}
+		}
+		this.Spec.Ports = append(this.Spec.Ports[:i], this.Spec.Ports[i+1:]...)
+		return nil
+	}
+	return errors.New(fmt.Sprintf("container ’%s’ does not forward %s", this.name, mapping))
+}
+
+// Installs the host rules of every port mapping of the container. Called
+// when the container starts. If a rule cannot be installed, the rules
+// already installed are removed again.
+func (this *Container) InstallPortForwarding() error {
+	if len(this.Spec.Ports) == 0 {
+		return nil
+	}
+	address, err := this.GetForwardingAddress()
+	if err != nil {
+		return err
+	}
+	err = this.CheckPortConflicts(this.Spec.Ports)
+	if err != nil {
+		return err
+	}
+	rules := make([][]string, 0)
+	for _, mapping := range this.Spec.Ports {
+		rules = append(rules, GetPortMappingRules(this.name, address, mapping)...)
+	}
+	return InstallIPTablesRules(rules)
+}
+
+// Removes the host rules of every port mapping of the container. Called
+// when the container stops. Every rule is attempted; the first error is
+// returned.
+func (this *Container) RemovePortForwarding() error {
+	if len(this.Spec.Ports) == 0 {
+		return nil
+	}
+	address, err := this.GetForwardingAddress()
+	if err != nil {
+		return err
+	}
+	var first_err error = nil
+	for _, mapping := range this.Spec.Ports {
+		for _, rule := range GetPortMappingRules(this.name, address, mapping) {
+			if err = RunIPTablesRule("-D", rule); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+				if first_err == nil {
+					first_err = err
+				}
+			}
+		}
+	}
+	return first_err
+}
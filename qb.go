@@ -6,13 +6,17 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	. "quickbuddy"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Stores the required number of arguments for each of the qb command
@@ -30,8 +34,8 @@ var required_cmd_nargs = map[string] int{
 	"st": 1,
 	"bstart": 1,
 	"bs": 1,
-	"create": 2,
-	"c": 2,
+	"create": -2, //requires cname iname [--userns]
+	"c": -2, //requires cname iname [--userns]
 	"mount": 1,
 	"m": 1,
 	"remount": 1,
@@ -49,6 +53,53 @@ var required_cmd_nargs = map[string] int{
 	"copy-image-set": 2,
 	"delete-image-set": 1,
 	"trim-image-set": 1,
+	"snapshot": -1, //requires cname [label]
+	"snapshots": 1,
+	"rollback": 2,
+	"snapshot-rm": 2,
+	"snapshot-prune": 1,
+	"snapshot-policy": 3,
+	"backup": -1, //requires cname --to DIR
+	"restore": -2, //requires src-cname cname --from DIR [--backup ID]
+	"backup-verify": -1, //requires DIR [cname ...]
+	"backups": -1, //requires DIR [cname]
+	"leases": 0,
+	"firewall": -2, //requires cname show|allow|deny|policy [args]
+	"port": -1, //requires cname [add|rm MAPPING] or --all
+	"network": -2, //requires cname show|add|rm [args]
+	"inspect": 1,
+	"net-limit": -1, //requires cname [--egress RATE] [--ingress RATE]
+	"netstat": 1,
+	"group": -1, //requires cname [GROUP|none]
+	"set-resources": -1, //requires cname [--SETTING VALUE ...]
+	"devices": -1, //requires cname [allow|deny DEVICE] or [preset NAME]
+	"capabilities": -1, //requires cname [PROFILE]
+	"capacity": 0,
+	"seccomp": -1, //requires cname [ACTION [ARG]]
+}
+
+// Stores the qb command line interface commands that take any number
+// of arguments, including none. Their arguments are checked by the
+// commands themselves.
+var variadic_cmds = map[string] bool{
+	"net-setup": true, //takes [--dry-run]
+	"net-teardown": true, //takes [--dry-run]
+	"stats": true, //takes [--watch N] [--json] [cname ...]
+	"metrics-server": true, //takes [--listen ADDR]
+	"oom-watch": true, //takes [--interval N]
+	"events": true, //takes [--follow] [cname ...]
+	"cpus": true, //takes [cname COUNT [--exclusive] | cname none | --rebalance]
+}
+
+// Stores the options that may be given more than once, e.g. once per
+// device. ParseOptions joins their values with newlines; other options
+// may be given only once.
+var repeatable_options = map[string] bool{
+	"--blkio-weight-device": true,
+	"--read-bps": true,
+	"--write-bps": true,
+	"--read-iops": true,
+	"--write-iops": true,
 }
 
 // Test container creation and mounting with Aufs using N threads
@@ -86,8 +137,13 @@ func Help() {
 		
                        * container commands *
 
-  create/c cname [iname] Prepares a new container named ’cname’
+  create/c cname [iname] [--userns]
+                         Prepares a new container named ’cname’
                          from the image set named ’iname’ (default).
+                         With --userns, ’cname’ runs unprivileged with
+                         its ids mapped to host subordinate ids; the
+                         files of the shared image set appear to be
+                         owned by nobody until they are changed.
   destroy/d cname        Destroys the container named ’cname’.
   mount/m cname          Mounts the container named ’cname’.
   remount cname          Remounts the container named ’cname’.
@@ -114,6 +170,134 @@ func Help() {
   delete-image-set iname      Delete the OS image set named ’iname’.
   trim-image-set iname        Removes unnecessary services from a container.
   copy-image-set src dest     Copy image set named ’src’ into image set ’dest’.
+
+                        * snapshot commands *
+
+  snapshot cname [label]      Snapshot the private data of ’cname’. Snapshots
+                              without a label are pruned by snapshot-prune.
+  snapshots cname             List the snapshots of ’cname’.
+  rollback cname label        Restore ’cname’ to the snapshot ’label’.
+  snapshot-rm cname label     Delete the snapshot ’label’ of ’cname’.
+  snapshot-prune cname        Delete snapshots outside the retention policy.
+  snapshot-policy cname h d   Keep the newest snapshot of the last ’h’ hours
+                              and of the last ’d’ days when pruning.
+
+                         * backup commands *
+
+  backup cname --to DIR       Back up ’cname’ into the backup store ’DIR’.
+                              Only changed files are stored.
+  restore src cname --from DIR [--backup ID]
+                              Restore the latest (or ’ID’) backup of ’src’
+                              as a new container named ’cname’.
+  backups DIR [cname]         List the backups in the backup store ’DIR’.
+  backup-verify DIR [cname]   Check the integrity of the stored chunks.
+
+                        * network commands *
+
+  leases                      List the addresses leased to containers from
+                              the subnet in /etc/quickbuddy.conf.
+  firewall cname show         Show the firewall policy of ’cname’.
+  firewall cname allow RULE [SOURCE]
+                              Accept inbound traffic matching ’RULE’
+                              (e.g. 8080/tcp, 53/udp, icmp), optionally
+                              only from the address or subnet ’SOURCE’.
+  firewall cname deny RULE [SOURCE]
+                              Remove a rule added with allow.
+  firewall cname policy in|out ACCEPT|DROP
+                              Set the policy for unmatched traffic (ACCEPT
+                              by default, as in the image sets).
+  port cname                  List the host ports forwarded to ’cname’.
+  port cname add|rm H:C[/PROTO]
+                              Forward host port ’H’ to port ’C’ of ’cname’
+                              while it runs (or stop forwarding it).
+  port --all                  List the forwarded ports of all containers.
+  network cname show          Show the network interfaces of ’cname’.
+  network cname add NAME MODE [LINK] [--vlan ID] [--macvlan-mode M]
+                      [--mtu N] [--ipv4 ADDR/PREFIX]
+                              Add an interface; MODE is none, host, veth,
+                              macvlan, or vlan. The first interface is
+                              given the leased address.
+  network cname rm NAME       Remove an interface.
+  inspect cname               Show the state, addresses, MAC addresses, and
+                              veth pair names of ’cname’.
+  net-limit cname [--egress RATE] [--ingress RATE]
+                              Show or set the bandwidth of ’cname’ (e.g.
+                              10mbit, or none for unlimited). Applied live
+                              if the container is running.
+  netstat cname               Show the traffic of ’cname’ since it was
+                              created, including restarts.
+  group cname [GROUP|none]    Show or set the group of ’cname’. Members of
+                              a group find each other’s names and static
+                              addresses in /etc/hosts.
+  net-setup [--dry-run]       Create the bridge with the gateway address,
+                              and enable forwarding and masquerading for
+                              the subnet. Steps already done are skipped;
+                              --dry-run only prints the operations.
+  net-teardown [--dry-run]    Reverse net-setup. A bridge net-setup did not
+                              create is kept.
+
+                        * resource commands *
+
+  set-resources cname [--memory SIZE] [--swap SIZE] [--cpu-shares N]
+                      [--cpus N] [--cpuset CPUS] [--blkio-weight N]
+                      [--blkio-weight-device DEV:N] [--read-bps DEV:SIZE]
+                      [--write-bps DEV:SIZE] [--read-iops DEV:N]
+                      [--write-iops DEV:N] [--pids N]
+                              Show or change the resources of ’cname’
+                              (e.g. --memory 1G --cpus 1.5); ’none’
+                              removes a limit. The DEV options may be
+                              repeated for several devices. A running
+                              container is changed immediately.
+  stats [--watch N] [--json] [cname ...]
+                              Show the memory, CPU, block I/O, task, and
+                              network usage of containers (all by default),
+                              refreshing every ’N’ seconds with --watch.
+  metrics-server [--listen ADDR]
+                              Serve the metrics of all containers for
+                              scraping at http://ADDR/metrics (default
+                              ADDR is :9101).
+  capacity                    Show the memory and CPUs reserved by running
+                              containers against the host’s capacity.
+  cpus                        List the CPUs allocated to containers.
+  cpus cname COUNT [--exclusive]
+                              Pin ’cname’ to ’COUNT’ CPUs, held by it alone
+                              with --exclusive or shared with the other
+                              containers otherwise. Exclusive CPUs are
+                              never overcommitted; containers without
+                              pinned CPUs run on the others.
+  cpus cname none             Release the CPUs of ’cname’.
+  cpus --rebalance            Reassign the CPUs of all containers (e.g.
+                              after CPUs went offline).
+  devices cname               Show the devices ’cname’ may access.
+  devices cname allow|deny DEVICE
+                              Allow or deny a device by name (e.g. fuse,
+                              tun, kvm), host node (e.g. /dev/kvm), or rule
+                              (e.g. "c 10:232 rwm") when ’cname’ starts.
+  devices cname preset NAME   Replace the devices of ’cname’ with a preset:
+                              default, minimal, or virtualization.
+  capabilities cname [PROFILE]
+                              Show or set the capability profile of ’cname’:
+                              default (drops sys_module), hardened (also
+                              drops capabilities reaching beyond the
+                              container), or minimal (keeps only what web
+                              services need). Applied when ’cname’ starts.
+  seccomp cname               Show the syscall filter of ’cname’.
+  seccomp cname default allow|deny|off
+                              Allow or deny syscalls not listed, or filter
+                              no syscalls.
+  seccomp cname allow|deny SYSCALL
+                              List a syscall as allowed or denied.
+  seccomp cname errno N       Fail denied syscalls with errno ’N’ (0 kills
+                              the process instead).
+  seccomp cname reset         Restore the default filter, which denies
+                              loading kernel modules, kexec, keyrings, and
+                              similar host-level syscalls.
+  oom-watch [--interval N]    Record an event whenever a running container
+                              runs out of memory, rescanning for started
+                              containers every ’N’ seconds (default 5).
+  events [--follow] [cname ...]
+                              Show the events of containers (all by
+                              default); --follow waits for new events.
 `)
 }
 
@@ -220,10 +404,21 @@ func CommandBlockedStartContainer(cname string) error {
 }
 
 // Implements the ’create’ CLI command.
-func CommandCreateContainer(cname string, iname string) error {
-	image_set := NewImageSet(iname, "/isx")
-	container := NewContainerFromImageSet(cname, "/web", image_set)
-	err := container.Create();
+func CommandCreateContainer(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--userns": false})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return errors.New("usage: create cname iname [--userns]")
+	}
+	image_set := NewImageSet(positional[1], "/isx")
+	container := NewContainerFromImageSet(positional[0], "/web", image_set)
+	if options["--userns"] == "true" {
+		// The ranges are allocated when the container is configured.
+		container.Spec.Userns = IdMap{Count: USERNS_RANGE_SIZE}
+	}
+	err = container.Create();
 	return err
 }
 
@@ -302,6 +497,1089 @@ func CommandCopyImageSet(src_iname string, dest_iname string) error {
 	return dest_image_set.Copy(src_image_set)
 }
 
+// Implements the ’snapshot’ CLI command.
+func CommandSnapshotContainer(cname string, args []string) error {
+	if len(args) > 1 {
+		return errors.New(fmt.Sprintf("command ’snapshot’ requires at most 2 argument(s) (%d given)", len(args)+1))
+	}
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	label := ""
+	if len(args) == 1 {
+		label = args[0]
+	}
+	snapshot, err := container.Snapshot(label)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", snapshot.Label)
+	return nil
+}
+
+// Implements the ’snapshots’ CLI command.
+func CommandListSnapshots(cname string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	snapshots, err := container.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		kind := "labeled"
+		if snapshot.Automatic {
+			kind = "automatic"
+		}
+		fmt.Printf("%-24s %s %s\n", snapshot.Label,
+			snapshot.Created.Format("2006-01-02 15:04:05"), kind)
+	}
+	return nil
+}
+
+// Implements the ’rollback’ CLI command.
+func CommandRollbackContainer(cname string, label string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	return container.Rollback(label)
+}
+
+// Implements the ’snapshot-rm’ CLI command.
+func CommandDeleteSnapshot(cname string, label string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	return container.DeleteSnapshot(label)
+}
+
+// Implements the ’snapshot-prune’ CLI command.
+func CommandPruneSnapshots(cname string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	pruned, err := container.PruneSnapshots()
+	for _, snapshot := range pruned {
+		fmt.Printf("pruned %s\n", snapshot.Label)
+	}
+	return err
+}
+
+// Implements the ’snapshot-policy’ CLI command.
+func CommandSetSnapshotPolicy(cname string, hourly string, daily string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	nhourly, err := strconv.Atoi(hourly)
+	if err != nil || nhourly < 0 {
+		return errors.New(fmt.Sprintf("invalid number of hourly snapshots ’%s’", hourly))
+	}
+	ndaily, err := strconv.Atoi(daily)
+	if err != nil || ndaily < 0 {
+		return errors.New(fmt.Sprintf("invalid number of daily snapshots ’%s’", daily))
+	}
+	container.Spec.Snapshot_retention = RetentionPolicy{Hourly: nhourly, Daily: ndaily}
+	return container.WriteSpec()
+}
+
+// Separates ’--name value’ and ’--name’ options from positional arguments.
+//
+// @param args The command arguments.
+// @param allowed The allowed option names mapped to whether they take a value.
+func ParseOptions(args []string, allowed map[string]bool) ([]string, map[string]string, error) {
+	positional := make([]string, 0)
+	options := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			positional = append(positional, args[i])
+			continue
+		}
+		name := args[i]
+		value := ""
+		has_value := false
+		if eq := strings.Index(name, "="); eq != -1 {
+			name, value, has_value = name[:eq], name[eq+1:], true
+		}
+		takes_value, present := allowed[name]
+		if !present {
+			return nil, nil, errors.New(fmt.Sprintf("invalid option ’%s’", name))
+		}
+		if takes_value && !has_value {
+			if i+1 >= len(args) {
+				return nil, nil, errors.New(fmt.Sprintf("option ’%s’ requires a value", name))
+			}
+			i++
+			value = args[i]
+		} else if !takes_value {
+			if has_value {
+				return nil, nil, errors.New(fmt.Sprintf("option ’%s’ does not take a value", name))
+			}
+			value = "true"
+		}
+		if previous, repeated := options[name]; repeated {
+			if !repeatable_options[name] {
+				return nil, nil, errors.New(fmt.Sprintf("option ’%s’ given more than once", name))
+			}
+			value = previous + "\n" + value
+		}
+		options[name] = value
+	}
+	return positional, options, nil
+}
+
+// Implements the ’backup’ CLI command.
+func CommandBackupContainer(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--to": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || options["--to"] == "" {
+		return errors.New("usage: backup cname --to DIR")
+	}
+	container, err := NewContainerFromImageSetMeta(positional[0], "/web")
+	if err != nil {
+		return err
+	}
+	manifest, err := container.Backup(NewBackupStore(options["--to"]))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", manifest.Id)
+	return nil
+}
+
+// Implements the ’restore’ CLI command.
+func CommandRestoreContainer(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--from": true, "--backup": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 || options["--from"] == "" {
+		return errors.New("usage: restore src-cname cname --from DIR [--backup ID]")
+	}
+	_, err = RestoreContainer(NewBackupStore(options["--from"]), positional[0], options["--backup"], positional[1], "/web")
+	return err
+}
+
+// Implements the ’backups’ CLI command.
+func CommandListBackups(args []string) error {
+	if len(args) > 2 {
+		return errors.New(fmt.Sprintf("command ’backups’ requires at most 2 argument(s) (%d given)", len(args)))
+	}
+	store := NewBackupStore(args[0])
+	cnames, err := store.ListContainers()
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		cnames = args[1:]
+	}
+	for _, cname := range cnames {
+		ids, err := store.ListBackups(cname)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			fmt.Printf("%-24s %s\n", cname, id)
+		}
+	}
+	return nil
+}
+
+// Implements the ’backup-verify’ CLI command.
+func CommandVerifyBackups(args []string) error {
+	return NewBackupStore(args[0]).Verify(args[1:])
+}
+
+// Implements the ’leases’ CLI command.
+func CommandListLeases() error {
+	leases, err := ReadAddressLeases("/web")
+	if err != nil {
+		return err
+	}
+	leases6, err := ReadIPv6AddressLeases("/web")
+	if err != nil {
+		return err
+	}
+	all := leases.GetAll()
+	cnames := make([]string, 0, len(all))
+	for cname, _ := range all {
+		cnames = append(cnames, cname)
+	}
+	sort.Strings(cnames)
+	for _, cname := range cnames {
+		if address6 := leases6.Lookup(cname); address6 != nil {
+			fmt.Printf("%-24s %-16s %s\n", cname, all[cname], address6)
+		} else {
+			fmt.Printf("%-24s %s\n", cname, all[cname])
+		}
+	}
+	return nil
+}
+
+// Implements the ’firewall’ CLI command.
+func CommandFirewall(cname string, action string, args []string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	policy := &container.Spec.Firewall
+	switch action {
+	case "show":
+		fmt.Printf("inbound policy %s\n", policy.Inbound_policy)
+		fmt.Printf("outbound policy %s\n", policy.Outbound_policy)
+		for _, rule := range policy.Inbound {
+			fmt.Printf("allow %s\n", rule)
+		}
+		return nil
+	case "allow", "deny":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New(fmt.Sprintf("usage: firewall cname %s RULE [SOURCE]", action))
+		}
+		source := ""
+		if len(args) == 2 {
+			source = args[1]
+		}
+		rule, err := ParseFirewallRule(args[0], source)
+		if err != nil {
+			return err
+		}
+		if action == "allow" {
+			if !policy.Allow(rule) {
+				return errors.New(fmt.Sprintf("container ’%s’ already allows %s", cname, rule))
+			}
+		} else if !policy.Deny(rule) {
+			return errors.New(fmt.Sprintf("container ’%s’ has no rule allowing %s", cname, rule))
+		}
+	case "policy":
+		if len(args) != 2 || (args[0] != "in" && args[0] != "out") {
+			return errors.New("usage: firewall cname policy in|out ACCEPT|DROP")
+		}
+		if args[0] == "in" {
+			policy.Inbound_policy = strings.ToUpper(args[1])
+		} else {
+			policy.Outbound_policy = strings.ToUpper(args[1])
+		}
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf("invalid firewall action ’%s’: expected show, allow, deny, or policy", action))
+	}
+	err = container.WriteSpec()
+	if err != nil {
+		return err
+	}
+	return container.ApplyFirewall()
+}
+
+// Implements the ’port’ CLI command.
+func CommandPort(args []string) error {
+	if args[0] == "--all" {
+		if len(args) != 1 {
+			return errors.New("usage: port --all")
+		}
+		containers, err := ListContainers("/web")
+		if err != nil {
+			return err
+		}
+		for _, container := range containers {
+			for _, mapping := range container.Spec.Ports {
+				fmt.Printf("%-24s %s\n", container.GetName(), mapping)
+			}
+		}
+		return nil
+	}
+	container, err := NewContainerFromImageSetMeta(args[0], "/web")
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		for _, mapping := range container.Spec.Ports {
+			fmt.Printf("%s\n", mapping)
+		}
+		return nil
+	}
+	if len(args) != 3 || (args[1] != "add" && args[1] != "rm") {
+		return errors.New("usage: port cname [add|rm HOSTPORT:CONTAINERPORT[/PROTO]]")
+	}
+	mapping, err := ParsePortMapping(args[2])
+	if err != nil {
+		return err
+	}
+	if args[1] == "add" {
+		err = container.AddPortMapping(mapping)
+	} else {
+		err = container.RemovePortMapping(mapping)
+	}
+	if err != nil {
+		return err
+	}
+	return container.WriteSpec()
+}
+
+// Implements the ’network’ CLI command.
+func CommandNetwork(cname string, action string, args []string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "show":
+		for _, iface := range container.Spec.Networks {
+			fmt.Printf("%-8s %-8s", iface.Name, iface.Mode)
+			if iface.Link != "" {
+				fmt.Printf(" link=%s", iface.Link)
+			}
+			if iface.Vlan_id != 0 {
+				fmt.Printf(" vlan=%d", iface.Vlan_id)
+			}
+			if iface.Macvlan_mode != "" {
+				fmt.Printf(" macvlan-mode=%s", iface.Macvlan_mode)
+			}
+			if iface.Mtu != 0 {
+				fmt.Printf(" mtu=%d", iface.Mtu)
+			}
+			if iface.Ipv4 != "" {
+				fmt.Printf(" ipv4=%s", iface.Ipv4)
+			}
+			fmt.Printf("\n")
+		}
+		if container.Spec.Ipv4 != "" {
+			fmt.Printf("leased address %s gateway %s\n", container.Spec.Ipv4, container.Spec.Ipv4_gateway)
+		}
+		if container.Spec.Ipv6 != "" {
+			fmt.Printf("leased address %s gateway %s\n", container.Spec.Ipv6, container.Spec.Ipv6_gateway)
+		}
+		return nil
+	case "add":
+		positional, options, err := ParseOptions(args, map[string]bool{
+			"--vlan": true, "--macvlan-mode": true, "--mtu": true, "--ipv4": true})
+		if err != nil {
+			return err
+		}
+		if len(positional) < 2 || len(positional) > 3 {
+			return errors.New("usage: network cname add NAME MODE [LINK] [options]")
+		}
+		iface := NetworkInterface{Name: positional[0], Mode: positional[1],
+			Macvlan_mode: options["--macvlan-mode"], Ipv4: options["--ipv4"]}
+		if len(positional) == 3 {
+			iface.Link = positional[2]
+		}
+		if options["--vlan"] != "" {
+			if iface.Vlan_id, err = strconv.Atoi(options["--vlan"]); err != nil {
+				return errors.New(fmt.Sprintf("invalid VLAN id ’%s’", options["--vlan"]))
+			}
+		}
+		if options["--mtu"] != "" {
+			if iface.Mtu, err = strconv.Atoi(options["--mtu"]); err != nil {
+				return errors.New(fmt.Sprintf("invalid MTU ’%s’", options["--mtu"]))
+			}
+		}
+		container.Spec.Networks = append(container.Spec.Networks, iface)
+	case "rm":
+		if len(args) != 1 {
+			return errors.New("usage: network cname rm NAME")
+		}
+		found := false
+		for i, iface := range container.Spec.Networks {
+			if iface.Name == args[0] {
+				container.Spec.Networks = append(container.Spec.Networks[:i], container.Spec.Networks[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New(fmt.Sprintf("container ’%s’ has no interface ’%s’", cname, args[0]))
+		}
+	default:
+		return errors.New(fmt.Sprintf("invalid network action ’%s’: expected show, add, or rm", action))
+	}
+	err = ValidateNetworkInterfaces(container.Spec.Networks)
+	if err != nil {
+		return err
+	}
+	err = container.AllocateAddress()
+	if err == nil {
+		err = container.AssignNetworkIdentifiers()
+	}
+	if err != nil {
+		return err
+	}
+	err = container.WriteSpec()
+	if err != nil {
+		return err
+	}
+	err = container.WriteConfig()
+	if err == nil && container.IsMounted() {
+		err = container.WriteInterfaces()
+	}
+	if err == nil {
+		err = UpdateDHCPHosts("/web")
+	}
+	if err == nil {
+		err = UpdateGroupHosts("/web", container.Spec.Group)
+	}
+	if err == nil && container.IsRunning() {
+		fmt.Fprintf(os.Stderr, "restart container ’%s’ for the network changes to take effect\n", cname)
+	}
+	return err
+}
+
+// Implements the ’inspect’ CLI command.
+func CommandInspect(cname string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	return container.Inspect(os.Stdout)
+}
+
+// Implements the ’net-limit’ CLI command.
+func CommandNetLimit(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--egress": true, "--ingress": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: net-limit cname [--egress RATE] [--ingress RATE]")
+	}
+	container, err := NewContainerFromImageSetMeta(positional[0], "/web")
+	if err != nil {
+		return err
+	}
+	if len(options) == 0 {
+		fmt.Printf("%s\n", container.Spec.Bandwidth)
+		return nil
+	}
+	limits := container.Spec.Bandwidth
+	for option, rate := range options {
+		if rate == "none" {
+			rate = ""
+		}
+		if option == "--egress" {
+			limits.Egress = rate
+		} else {
+			limits.Ingress = rate
+		}
+	}
+	err = limits.Validate()
+	if err != nil {
+		return err
+	}
+	container.Spec.Bandwidth = limits
+	if container.IsRunning() {
+		err = container.InstallRateLimits()
+		if err != nil {
+			return err
+		}
+	}
+	return container.WriteSpec()
+}
+
+// Implements the ’netstat’ CLI command.
+func CommandNetstat(cname string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	totals, err := container.CollectTraffic()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-16s %d bytes %d packets\n", "received", totals.Total.Rx_bytes, totals.Total.Rx_packets)
+	fmt.Printf("%-16s %d bytes %d packets\n", "sent", totals.Total.Tx_bytes, totals.Total.Tx_packets)
+	mappings := make([]string, 0, len(totals.Total.Forwarded_bytes))
+	for mapping, _ := range totals.Total.Forwarded_bytes {
+		mappings = append(mappings, mapping)
+	}
+	sort.Strings(mappings)
+	for _, mapping := range mappings {
+		fmt.Printf("%-16s %d bytes\n", "port "+mapping, totals.Total.Forwarded_bytes[mapping])
+	}
+	if totals.Updated != 0 {
+		fmt.Printf("%-16s %s\n", "updated", time.Unix(totals.Updated, 0).Format(time.RFC1123))
+	}
+	return nil
+}
+
+// Implements the ’group’ CLI command.
+func CommandGroup(cname string, args []string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		if container.Spec.Group != "" {
+			fmt.Printf("%s\n", container.Spec.Group)
+		}
+		return nil
+	}
+	if len(args) > 1 {
+		return errors.New("usage: group cname [GROUP|none]")
+	}
+	group := args[0]
+	if group == "none" {
+		group = ""
+	}
+	err = ValidateGroupName(group)
+	if err != nil {
+		return err
+	}
+	old_group := container.Spec.Group
+	container.Spec.Group = group
+	err = container.WriteSpec()
+	if err != nil {
+		return err
+	}
+	if container.IsMounted() {
+		err = container.WriteHosts()
+		if err != nil {
+			return err
+		}
+	}
+	err = UpdateGroupHosts("/web", old_group)
+	if err != nil {
+		return err
+	}
+	return UpdateGroupHosts("/web", group)
+}
+
+// Implements the ’net-setup’ and ’net-teardown’ CLI commands.
+func CommandHostNetwork(command string, args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--dry-run": false})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errors.New(fmt.Sprintf("usage: %s [--dry-run]", command))
+	}
+	config, err := GetHostConfig()
+	if err != nil {
+		return err
+	}
+	if command == "net-setup" {
+		return SetUpHostNetwork(config, "/web", options["--dry-run"] == "true")
+	}
+	return TearDownHostNetwork(config, "/web", options["--dry-run"] == "true")
+}
+
+// Implements the ’set-resources’ CLI command.
+func CommandSetResources(args []string) error {
+	allowed := make(map[string]bool)
+	for _, name := range GetResourceSettingNames() {
+		allowed["--"+name] = true
+	}
+	positional, options, err := ParseOptions(args, allowed)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: set-resources cname [--SETTING VALUE ...]")
+	}
+	container, err := NewContainerFromImageSetMeta(positional[0], "/web")
+	if err != nil {
+		return err
+	}
+	if len(options) == 0 {
+		for _, setting := range container.Spec.Resources.GetSettingStrings() {
+			fmt.Printf("%s\n", setting)
+		}
+		return nil
+	}
+	// The admission lock is taken before the allocation lock, as by ’cpus’.
+	admission_lock, err := LockAdmission("/web")
+	if err != nil {
+		return err
+	}
+	defer admission_lock.Close()
+	if cpuset, present := options["--cpuset"]; present {
+		// Hold the allocations until the cpuset is saved so no CPU it
+		// includes is meanwhile held exclusively.
+		lock, err := LockFile(GetCpuAllocationsPathname("/web") + ".lock")
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+		allocations, err := ReadCpuAllocations("/web")
+		if err != nil {
+			return err
+		}
+		if allocations[positional[0]] != nil {
+			return errors.New(fmt.Sprintf("the cpuset of ’%s’ is allocated by ’qb cpus’; release it with ’qb cpus %s none’ first",
+				positional[0], positional[0]))
+		}
+		if cpuset != "none" {
+			if err = allocations.CheckShared(positional[0], cpuset); err != nil {
+				return err
+			}
+		}
+	}
+	old_resources := container.Spec.Resources
+	resources := old_resources
+	resources.Blkio_devices = append([]BlkioDeviceLimit{}, old_resources.Blkio_devices...)
+	for _, name := range GetResourceSettingNames() {
+		if values, present := options["--"+name]; present {
+			for _, value := range strings.Split(values, "\n") {
+				if err = resources.Set(name, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// A stopped container is checked when it starts.
+	if container.IsRunning() {
+		if err = container.CheckAdmission(resources.GetReservation()); err != nil {
+			return err
+		}
+	}
+	container.Spec.Resources = resources
+	// Render the configuration first so settings the host’s cgroup
+	// version cannot express are rejected before anything is changed.
+	err = container.WriteConfig()
+	if err != nil {
+		container.Spec.Resources = old_resources
+		return err
+	}
+	err = container.WriteSpec()
+	if err != nil {
+		return err
+	}
+	if _, pid_err := container.GetInitPid(); pid_err != nil && !container.IsRunning() {
+		return nil
+	}
+	live_resources, err := container.GetLiveResources(&resources)
+	if err != nil {
+		return err
+	}
+	rejected, err := container.ApplyResourcesLive(&old_resources, &live_resources)
+	if err != nil {
+		return err
+	}
+	for _, write := range rejected {
+		fmt.Fprintf(os.Stderr, "the kernel rejected %s = %s: %s\n", write.File, write.Value, write.Err)
+	}
+	if len(rejected) > 0 {
+		return errors.New(fmt.Sprintf("%d value(s) were not applied to the running container ’%s’ (they take effect when it restarts)",
+			len(rejected), container.GetName()))
+	}
+	return nil
+}
+
+// Implements the ’stats’ CLI command.
+func CommandStats(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--watch": true, "--json": false})
+	if err != nil {
+		return err
+	}
+	interval := 0
+	if options["--watch"] != "" {
+		interval, err = strconv.Atoi(options["--watch"])
+		if err != nil || interval < 1 {
+			return errors.New(fmt.Sprintf("invalid interval ’%s’: expected a number of seconds", options["--watch"]))
+		}
+	}
+	containers := make([]*Container, 0)
+	if len(positional) == 0 {
+		containers, err = ListContainers("/web")
+		if err != nil {
+			return err
+		}
+	}
+	for _, cname := range positional {
+		container, err := NewContainerFromImageSetMeta(cname, "/web")
+		if err != nil {
+			return err
+		}
+		containers = append(containers, container)
+	}
+	for {
+		all_stats := make([]*ContainerStats, 0, len(containers))
+		for _, container := range containers {
+			stats, err := container.Stats()
+			if err != nil {
+				return err
+			}
+			all_stats = append(all_stats, stats)
+		}
+		if options["--json"] == "true" {
+			// One JSON array per line so --watch output can be streamed.
+			stats_bytes, err := json.Marshal(all_stats)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", stats_bytes)
+		} else {
+			if interval != 0 {
+				// Clear the terminal before each refresh.
+				fmt.Printf("\033[H\033[2J")
+			}
+			OutputStats(all_stats)
+		}
+		if interval == 0 {
+			return nil
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// Implements the ’metrics-server’ CLI command.
+func CommandMetricsServer(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--listen": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errors.New(fmt.Sprintf("unexpected argument ’%s’", positional[0]))
+	}
+	listen := ":9101"
+	if options["--listen"] != "" {
+		listen = options["--listen"]
+	}
+	fmt.Printf("serving metrics at %s/metrics\n", listen)
+	return ServeMetrics(listen, "/web")
+}
+
+// Implements the ’devices’ CLI command.
+func CommandDevices(cname string, args []string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	policy := &container.Spec.Devices
+	if len(args) == 0 {
+		if policy.Preset != "" {
+			fmt.Printf("preset %s\n", policy.Preset)
+		}
+		fmt.Printf("deny a *:* rwm\n")
+		for _, rule := range policy.Allow {
+			fmt.Printf("allow %-16s %s\n", rule, rule.Name)
+		}
+		return nil
+	}
+	if len(args) != 2 {
+		return errors.New("usage: devices cname [allow|deny DEVICE] or [preset NAME]")
+	}
+	old_policy := *policy
+	old_policy.Allow = append([]DeviceRule{}, policy.Allow...)
+	switch args[0] {
+	case "allow":
+		err = policy.AllowDevice(args[1])
+	case "deny":
+		err = policy.DenyDevice(args[1])
+	case "preset":
+		*policy, err = NewDevicePolicy(args[1])
+	default:
+		err = errors.New(fmt.Sprintf("invalid devices action ’%s’: expected allow, deny, or preset", args[0]))
+	}
+	if err != nil {
+		return err
+	}
+	err = container.WriteConfig()
+	if err != nil {
+		container.Spec.Devices = old_policy
+		return err
+	}
+	err = container.WriteSpec()
+	if err != nil {
+		return err
+	}
+	if container.IsRunning() {
+		fmt.Printf("the device policy of ’%s’ takes effect when it is restarted\n", cname)
+	}
+	return nil
+}
+
+// Implements the ’capabilities’ CLI command.
+func CommandCapabilities(cname string, args []string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		fmt.Printf("%s\n", container.Spec.Capabilities.Name)
+		return nil
+	}
+	if len(args) > 1 {
+		return errors.New("usage: capabilities cname [PROFILE]")
+	}
+	profile, err := GetCapabilityProfile(args[0])
+	if err != nil {
+		return err
+	}
+	old_profile := container.Spec.Capabilities
+	container.Spec.Capabilities = profile
+	err = container.WriteConfig()
+	if err != nil {
+		container.Spec.Capabilities = old_profile
+		return err
+	}
+	err = container.WriteSpec()
+	if err != nil {
+		return err
+	}
+	if container.IsRunning() {
+		fmt.Printf("the capabilities of ’%s’ take effect when it is restarted\n", cname)
+	}
+	return nil
+}
+
+// Implements the ’seccomp’ CLI command.
+func CommandSeccomp(cname string, args []string) error {
+	container, err := NewContainerFromImageSetMeta(cname, "/web")
+	if err != nil {
+		return err
+	}
+	profile := &container.Spec.Seccomp
+	if len(args) == 0 {
+		fmt.Printf("%s\n", profile)
+		for _, name := range profile.Allow {
+			fmt.Printf("allow %s\n", name)
+		}
+		for _, name := range profile.Deny {
+			fmt.Printf("deny %s\n", name)
+		}
+		return nil
+	}
+	old_profile := *profile
+	old_profile.Allow = append([]string{}, profile.Allow...)
+	old_profile.Deny = append([]string{}, profile.Deny...)
+	switch {
+	case args[0] == "reset" && len(args) == 1:
+		*profile = NewDefaultSeccompProfile()
+	case args[0] == "default" && len(args) == 2:
+		if args[1] == "off" {
+			args[1] = ""
+		}
+		profile.Default_action = args[1]
+	case (args[0] == "allow" || args[0] == "deny") && len(args) == 2:
+		changed, err := profile.SetSyscall(args[1], args[0] == "allow")
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return errors.New(fmt.Sprintf("container ’%s’ already %ss ’%s’", cname, args[0], args[1]))
+		}
+	case args[0] == "errno" && len(args) == 2:
+		profile.Errno, err = strconv.Atoi(args[1])
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid errno ’%s’", args[1]))
+		}
+	default:
+		return errors.New("usage: seccomp cname [default allow|deny|off] [allow|deny SYSCALL] [errno N] [reset]")
+	}
+	if err = profile.Validate(); err != nil {
+		return err
+	}
+	err = container.WriteConfig()
+	if err != nil {
+		container.Spec.Seccomp = old_profile
+		return err
+	}
+	err = container.WriteSpec()
+	if err != nil {
+		return err
+	}
+	if container.IsRunning() {
+		fmt.Printf("the seccomp profile of ’%s’ takes effect when it is restarted\n", cname)
+	}
+	return nil
+}
+
+// Implements the ’cpus’ CLI command.
+func CommandCpus(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--exclusive": false, "--rebalance": false})
+	if err != nil {
+		return err
+	}
+	var changed map[string]string
+	switch {
+	case len(positional) == 0 && options["--rebalance"] == "true":
+		changed, err = UpdateCpuAllocations("/web", func(allocations CpuAllocations) error {
+			return nil
+		})
+	case len(positional) == 0:
+		allocations, err := ReadCpuAllocations("/web")
+		if err != nil {
+			return err
+		}
+		for _, name := range allocations.GetSortedNames() {
+			allocation := allocations[name]
+			kind := "shared"
+			if allocation.Exclusive {
+				kind = "exclusive"
+			}
+			fmt.Printf("%-24s %3d %-9s %s\n", name, allocation.Count, kind, FormatCpuList(allocation.Cpus))
+		}
+		return nil
+	case len(positional) == 2 && positional[1] == "none":
+		changed, err = ReleaseCpus("/web", positional[0])
+	case len(positional) == 2:
+		var container *Container
+		if container, err = NewContainerFromImageSetMeta(positional[0], "/web"); err != nil {
+			return err
+		}
+		count, count_err := strconv.Atoi(positional[1])
+		if count_err != nil {
+			return errors.New(fmt.Sprintf("invalid CPU count ’%s’", positional[1]))
+		}
+		admission_lock, lock_err := LockAdmission("/web")
+		if lock_err != nil {
+			return lock_err
+		}
+		defer admission_lock.Close()
+		// A container without a CPU quota reserves the CPUs of its cpuset.
+		requested := container.Spec.Resources.GetReservation()
+		if container.Spec.Resources.Cpus == 0 {
+			requested.Cpus = float64(count)
+		}
+		if container.IsRunning() {
+			if err = container.CheckAdmission(requested); err != nil {
+				return err
+			}
+		}
+		changed, err = AllocateCpus("/web", positional[0], count, options["--exclusive"] == "true")
+	default:
+		return errors.New("usage: cpus [cname COUNT [--exclusive] | cname none | --rebalance]")
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range GetSortedKeysOfStrings(changed) {
+		fmt.Printf("%-24s %s\n", name, changed[name])
+	}
+	return ApplyCpuAllocations("/web", changed)
+}
+
+// Implements the ’capacity’ CLI command.
+func CommandCapacity() error {
+	config, err := GetHostConfig()
+	if err != nil {
+		return err
+	}
+	report, err := GetCapacityReport("/web", config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-8s %10s %10s %10s %10s %10s\n", "", "reserved", "capacity", "overcommit", "limit", "available")
+	fmt.Printf("%-8s %10s %10s %10g %10s %10s\n", "memory",
+		FormatApproximateByteSize(uint64(report.Reserved.Memory)),
+		FormatApproximateByteSize(uint64(report.Capacity.Memory)), config.Memory_overcommit,
+		FormatApproximateByteSize(uint64(report.Limit.Memory)),
+		FormatApproximateByteSize(uint64(math.Max(0, float64(report.Limit.Memory - report.Reserved.Memory)))))
+	fmt.Printf("%-8s %10g %10g %10g %10g %10g\n", "cpus", report.Reserved.Cpus, report.Capacity.Cpus,
+		config.Cpu_overcommit, report.Limit.Cpus, math.Max(0, report.Limit.Cpus - report.Reserved.Cpus))
+	fmt.Printf("admission: %s\n", config.Admission)
+	names := make([]string, 0, len(report.Running))
+	for name, _ := range report.Running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		reservation := report.Running[name]
+		memory := "-"
+		if reservation.Memory != 0 {
+			memory = FormatApproximateByteSize(uint64(reservation.Memory))
+		}
+		fmt.Printf("%-24s %10s %6g cpus\n", name, memory, reservation.Cpus)
+	}
+	return nil
+}
+
+// Implements the ’oom-watch’ CLI command.
+func CommandOOMWatch(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--interval": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errors.New(fmt.Sprintf("unexpected argument ’%s’", positional[0]))
+	}
+	interval := 5
+	if options["--interval"] != "" {
+		interval, err = strconv.Atoi(options["--interval"])
+		if err != nil || interval < 1 {
+			return errors.New(fmt.Sprintf("invalid interval ’%s’: expected a number of seconds", options["--interval"]))
+		}
+	}
+	return WatchAllOOMEvents("/web", time.Duration(interval) * time.Second)
+}
+
+// Implements the ’events’ CLI command.
+func CommandEvents(args []string) error {
+	positional, options, err := ParseOptions(args, map[string]bool{"--follow": false})
+	if err != nil {
+		return err
+	}
+	containers := make([]*Container, 0)
+	if len(positional) == 0 {
+		containers, err = ListContainers("/web")
+		if err != nil {
+			return err
+		}
+	}
+	for _, cname := range positional {
+		container, err := NewContainerFromImageSetMeta(cname, "/web")
+		if err != nil {
+			return err
+		}
+		containers = append(containers, container)
+	}
+	last_seen := make([]uint64, len(containers))
+	for {
+		for i, container := range containers {
+			events, err := container.ReadEventsAfter(last_seen[i])
+			if err != nil {
+				return err
+			}
+			for _, event := range events {
+				fmt.Printf("%s %-20s %-8s %s\n", time.Unix(event.Time, 0).Format("2006-01-02 15:04:05"),
+					event.Container, event.Type, event.Detail)
+				last_seen[i] = event.Sequence
+			}
+		}
+		if options["--follow"] != "true" {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Writes container statistics to standard output as a table.
+func OutputStats(all_stats []*ContainerStats) {
+	fmt.Printf("%-20s %-8s %-19s %-8s %-10s %-6s %-19s %s\n",
+		"NAME", "STATE", "MEMORY", "FAILCNT", "CPU", "TASKS", "BLOCK READ/WRITE", "NET RX/TX")
+	for _, stats := range all_stats {
+		state := "stopped"
+		if stats.Running {
+			state = "running"
+		}
+		limit := "-"
+		if stats.Memory_limit != 0 {
+			limit = FormatByteSize(int64(stats.Memory_limit))
+		}
+		var read_bytes, write_bytes uint64
+		for _, device := range stats.Blkio {
+			read_bytes += device.Read_bytes
+			write_bytes += device.Write_bytes
+		}
+		fmt.Printf("%-20s %-8s %-19s %-8d %-10s %-6d %-19s %s\n",
+			stats.Name, state,
+			FormatApproximateByteSize(stats.Memory_usage)+" / "+limit,
+			stats.Memory_failcnt,
+			fmt.Sprintf("%.2fs", float64(stats.Cpu_usage)/1e9),
+			stats.Tasks,
+			FormatApproximateByteSize(read_bytes)+" / "+FormatApproximateByteSize(write_bytes),
+			FormatApproximateByteSize(stats.Network.Rx_bytes)+" / "+FormatApproximateByteSize(stats.Network.Tx_bytes))
+	}
+}
+
 // Implements the ’execute’ CLI command.
 func CommandExecuteInContainer(cname string, user string, args []string) error {
 	container, err := NewContainerFromImageSetMeta(cname, "/web")
@@ -381,8 +1659,13 @@ func ProcessInput(command string, args []string) error {
 	required_nargs, present := required_cmd_nargs[command]
 	var err error = nil
 	required_nargs, present = required_cmd_nargs[command]
+	// Return an error if the command does not exist.
+	if !present && !variadic_cmds[command] {
+		return errors.New(fmt.Sprintf("invalid command ’%s’", command))
+	}
 	// If the command exists in our map, check that the number of
-	// arguments to it is correct.
+	// arguments to it is correct. Variadic commands are not in the map
+	// and check their own arguments.
 	if present {
 		// If the required_nargs is negative, then it is interpreted
 		// as "at least".
@@ -400,9 +1683,6 @@ func ProcessInput(command string, args []string) error {
 nt(s) (%d given)", command, required_nargs, actual_nargs))
 			}
 		}
-	} else {
-		// Otherwise, return an error that the command does not exist.
-		return errors.New(fmt.Sprintf("invalid command ’%s’", command))
 	}
 	// Now that the command exists and has the right number of arguments,
 	// call a function that processes that command.
@@ -412,7 +1692,7 @@ nt(s) (%d given)", command, required_nargs, actual_nargs))
 	case "bstart", "bs":
 		err = CommandBlockedStartContainer(args[0])
 	case "create", "c":
-		err = CommandCreateContainer(args[0], args[1])
+		err = CommandCreateContainer(args)
 	case "stop", "st":
 		err = CommandStopContainer(args[0])
 	case "destroy", "delete", "d":
@@ -445,6 +1725,64 @@ nt(s) (%d given)", command, required_nargs, actual_nargs))
 		err = CommandTrimImageSet(args[0])
 	case "delete-image-set":
 		err = CommandDeleteImageSet(args[0])
+	case "snapshot":
+		err = CommandSnapshotContainer(args[0], args[1:])
+	case "snapshots":
+		err = CommandListSnapshots(args[0])
+	case "rollback":
+		err = CommandRollbackContainer(args[0], args[1])
+	case "snapshot-rm":
+		err = CommandDeleteSnapshot(args[0], args[1])
+	case "snapshot-prune":
+		err = CommandPruneSnapshots(args[0])
+	case "snapshot-policy":
+		err = CommandSetSnapshotPolicy(args[0], args[1], args[2])
+	case "backup":
+		err = CommandBackupContainer(args)
+	case "restore":
+		err = CommandRestoreContainer(args)
+	case "backups":
+		err = CommandListBackups(args)
+	case "backup-verify":
+		err = CommandVerifyBackups(args)
+	case "leases":
+		err = CommandListLeases()
+	case "firewall":
+		err = CommandFirewall(args[0], args[1], args[2:])
+	case "port":
+		err = CommandPort(args)
+	case "network":
+		err = CommandNetwork(args[0], args[1], args[2:])
+	case "inspect":
+		err = CommandInspect(args[0])
+	case "net-limit":
+		err = CommandNetLimit(args)
+	case "netstat":
+		err = CommandNetstat(args[0])
+	case "group":
+		err = CommandGroup(args[0], args[1:])
+	case "net-setup", "net-teardown":
+		err = CommandHostNetwork(command, args)
+	case "set-resources":
+		err = CommandSetResources(args)
+	case "devices":
+		err = CommandDevices(args[0], args[1:])
+	case "capabilities":
+		err = CommandCapabilities(args[0], args[1:])
+	case "seccomp":
+		err = CommandSeccomp(args[0], args[1:])
+	case "stats":
+		err = CommandStats(args)
+	case "metrics-server":
+		err = CommandMetricsServer(args)
+	case "oom-watch":
+		err = CommandOOMWatch(args)
+	case "cpus":
+		err = CommandCpus(args)
+	case "capacity":
+		err = CommandCapacity()
+	case "events":
+		err = CommandEvents(args)
 	case "help", "--help", "-h":
 		Help()
 		os.Exit(0)
@@ -0,0 +1,467 @@
+/// File: resources.go
+/// Purpose: Describes the resources a container may use (memory, CPU, block
+/// I/O, processes) and renders them as cgroup settings.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The CFS period used to express CPU quotas, in microseconds.
+const CPU_PERIOD_US int64 = 100000
+
+// Matches cpusets such as "0-3,6".
+var cpuset_pattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// Limits the block I/O of a container on one device. Zero means unlimited.
+type BlkioDeviceLimit struct {
+
+	/* The device as MAJOR:MINOR (e.g. "8:0"). */
+	Device string;
+
+	/* The proportional weight on the device (10-1000). */
+	Weight int;
+
+	Read_bps int64;
+	Write_bps int64;
+	Read_iops int64;
+	Write_iops int64;
+}
+
+// Describes the resources a container may use. Zero values mean
+// unlimited (or the kernel’s default).
+type Resources struct {
+
+	/* The memory limit in bytes (setting ’memory’, e.g. "512M"). */
+	Memory int64;
+
+	/* The swap the container may use in addition to its memory, in bytes
+	   (setting ’swap’). Requires a memory limit. */
+	Swap int64;
+
+	/* The relative CPU weight (setting ’cpu-shares’, 2-262144). */
+	Cpu_shares int;
+
+	/* The number of CPUs the container may use (setting ’cpus’, e.g.
+	   "1.5 cpus"), enforced as a CFS quota. */
+	Cpus float64;
+
+	/* The CPUs the container may run on (setting ’cpuset’, e.g. "0-3"). */
+	Cpuset string;
+
+	/* The proportional block I/O weight (setting ’blkio-weight’,
+	   10-1000). */
+	Blkio_weight int;
+
+	/* The per-device block I/O weights and throttles (settings
+	   ’blkio-weight-device’, ’read-bps’, ’write-bps’, ’read-iops’, and
+	   ’write-iops’, each given as DEVICE:VALUE). */
+	Blkio_devices []BlkioDeviceLimit;
+
+	/* The maximum number of processes (setting ’pids’). */
+	Pids int64;
+}
+
+// Returns the names of the settings accepted by Resources.Set.
+func GetResourceSettingNames() []string {
+	return []string{"memory", "swap", "cpu-shares", "cpus", "cpuset", "blkio-weight",
+		"blkio-weight-device", "read-bps", "write-bps", "read-iops", "write-iops", "pids"}
+}
+
+// Parses a size in bytes with an optional binary suffix K, M, G, or T
+// (e.g. "512M", "1.5G", "4096").
+func ParseByteSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	multiplier := int64(1)
+	if size != "" {
+		switch strings.ToUpper(size[len(size)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			size = size[:len(size)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid size ’%s’: expected e.g. 512M or 2G", size))
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// Returns a size in bytes with the largest binary suffix that represents
+// it exactly (e.g. 536870912 is "512M").
+func FormatByteSize(size int64) string {
+	for _, unit := range []struct {
+		suffix string
+		bytes int64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if size >= unit.bytes && size%unit.bytes == 0 {
+			return fmt.Sprintf("%d%s", size/unit.bytes, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+// Returns a size in bytes rounded to one decimal of the largest binary
+// suffix not exceeding it (e.g. 123456789 is "117.7M").
+func FormatApproximateByteSize(size uint64) string {
+	for _, unit := range []struct {
+		suffix string
+		bytes uint64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if size >= unit.bytes {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(unit.bytes), unit.suffix)
+		}
+	}
+	return strconv.FormatUint(size, 10)
+}
+
+// Parses a number of CPUs, optionally followed by "cpus" (e.g. "1.5 cpus").
+func ParseCpus(cpus string) (float64, error) {
+	number := strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(cpus), "cpus"), "cpu"))
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0.01 {
+		return 0, errors.New(fmt.Sprintf("invalid number of CPUs ’%s’: expected e.g. 1.5 cpus", cpus))
+	}
+	return value, nil
+}
+
+// Returns the MAJOR:MINOR of a block device given either its MAJOR:MINOR
+// or its pathname (e.g. "/dev/sda").
+func ParseBlockDevice(device string) (string, error) {
+	if !strings.HasPrefix(device, "/") {
+		numbers := strings.Split(device, ":")
+		if len(numbers) == 2 {
+			major, err1 := strconv.Atoi(numbers[0])
+			minor, err2 := strconv.Atoi(numbers[1])
+			if err1 == nil && err2 == nil && major >= 0 && minor >= 0 {
+				return fmt.Sprintf("%d:%d", major, minor), nil
+			}
+		}
+		return "", errors.New(fmt.Sprintf("invalid device ’%s’: expected MAJOR:MINOR or a pathname", device))
+	}
+	info, err := os.Stat(device)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return "", errors.New(fmt.Sprintf("’%s’ is not a block device", device))
+	}
+	rdev := uint64(stat.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+// Returns the limits on a device, adding them if the device has none.
+func (this *Resources) GetBlkioDevice(device string) *BlkioDeviceLimit {
+	for i := range this.Blkio_devices {
+		if this.Blkio_devices[i].Device == device {
+			return &this.Blkio_devices[i]
+		}
+	}
+	this.Blkio_devices = append(this.Blkio_devices, BlkioDeviceLimit{Device: device})
+	return &this.Blkio_devices[len(this.Blkio_devices)-1]
+}
+
+// Sets one resource from its human readable form. A value of "none"
+// removes the limit. The resources are unchanged if an error is returned.
+//
+// @param name The name of the setting (see GetResourceSettingNames).
+// @param value The value (e.g. "512M", "1.5 cpus", "/dev/sda:10M").
+func (this *Resources) Set(name string, value string) error {
+	saved := *this
+	saved.Blkio_devices = append([]BlkioDeviceLimit{}, this.Blkio_devices...)
+	err := this.set(name, value)
+	if err != nil {
+		*this = saved
+	}
+	return err
+}
+
+// Implements Set without restoring the resources on error.
+func (this *Resources) set(name string, value string) error {
+	var err error
+	unset := value == "none"
+	switch name {
+	case "memory", "swap":
+		var size int64
+		if !unset {
+			if size, err = ParseByteSize(value); err != nil {
+				return err
+			}
+		}
+		if name == "memory" {
+			this.Memory = size
+		} else {
+			this.Swap = size
+		}
+	case "cpu-shares", "blkio-weight":
+		number := 0
+		if !unset {
+			if number, err = strconv.Atoi(value); err != nil {
+				return errors.New(fmt.Sprintf("invalid %s ’%s’", name, value))
+			}
+		}
+		if name == "cpu-shares" {
+			this.Cpu_shares = number
+		} else {
+			this.Blkio_weight = number
+		}
+	case "cpus":
+		this.Cpus = 0
+		if !unset {
+			this.Cpus, err = ParseCpus(value)
+		}
+	case "cpuset":
+		this.Cpuset = ""
+		if !unset {
+			this.Cpuset = value
+		}
+	case "pids":
+		this.Pids = 0
+		if !unset {
+			if this.Pids, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return errors.New(fmt.Sprintf("invalid pids ’%s’", value))
+			}
+		}
+	case "blkio-weight-device", "read-bps", "write-bps", "read-iops", "write-iops":
+		colon := strings.LastIndex(value, ":")
+		if colon == -1 {
+			return errors.New(fmt.Sprintf("invalid %s ’%s’: expected DEVICE:VALUE", name, value))
+		}
+		device, err := ParseBlockDevice(value[:colon])
+		if err != nil {
+			return err
+		}
+		var number int64
+		if value[colon+1:] != "none" {
+			if name == "read-bps" || name == "write-bps" {
+				number, err = ParseByteSize(value[colon+1:])
+			} else {
+				number, err = strconv.ParseInt(value[colon+1:], 10, 64)
+			}
+			if err != nil {
+				return errors.New(fmt.Sprintf("invalid %s ’%s’", name, value))
+			}
+		}
+		limit := this.GetBlkioDevice(device)
+		switch name {
+		case "blkio-weight-device":
+			limit.Weight = int(number)
+		case "read-bps":
+			limit.Read_bps = number
+		case "write-bps":
+			limit.Write_bps = number
+		case "read-iops":
+			limit.Read_iops = number
+		case "write-iops":
+			limit.Write_iops = number
+		}
+		if *limit == (BlkioDeviceLimit{Device: device}) {
+			this.RemoveBlkioDevice(device)
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown resource ’%s’: expected one of %s", name, strings.Join(GetResourceSettingNames(), ", ")))
+	}
+	if err != nil {
+		return err
+	}
+	return this.Validate()
+}
+
+// Removes the limits on a device.
+func (this *Resources) RemoveBlkioDevice(device string) {
+	for i := range this.Blkio_devices {
+		if this.Blkio_devices[i].Device == device {
+			this.Blkio_devices = append(this.Blkio_devices[:i], this.Blkio_devices[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns nil iff every resource is within the range the kernel accepts.
+func (this *Resources) Validate() error {
+	if this.Memory < 0 || this.Swap < 0 || this.Pids < 0 || this.Cpus < 0 {
+		return errors.New("resource limits must not be negative")
+	}
+	if this.Memory != 0 && this.Memory < 4<<20 {
+		return errors.New(fmt.Sprintf("memory limit %s is below the minimum of 4M", FormatByteSize(this.Memory)))
+	}
+	if this.Swap != 0 && this.Memory == 0 {
+		return errors.New("a swap limit requires a memory limit")
+	}
+	if this.Cpu_shares != 0 && (this.Cpu_shares < 2 || this.Cpu_shares > 262144) {
+		return errors.New(fmt.Sprintf("invalid cpu-shares %d: expected 2-262144", this.Cpu_shares))
+	}
+	if this.Cpuset != "" && !cpuset_pattern.MatchString(this.Cpuset) {
+		return errors.New(fmt.Sprintf("invalid cpuset ’%s’: expected e.g. 0-3,6", this.Cpuset))
+	}
+	if this.Blkio_weight != 0 && (this.Blkio_weight < 10 || this.Blkio_weight > 1000) {
+		return errors.New(fmt.Sprintf("invalid blkio-weight %d: expected 10-1000", this.Blkio_weight))
+	}
+	for _, limit := range this.Blkio_devices {
+		if limit.Weight != 0 && (limit.Weight < 10 || limit.Weight > 1000) {
+			return errors.New(fmt.Sprintf("invalid blkio weight %d for device %s: expected 10-1000", limit.Weight, limit.Device))
+		}
+		if limit.Read_bps < 0 || limit.Write_bps < 0 || limit.Read_iops < 0 || limit.Write_iops < 0 {
+			return errors.New(fmt.Sprintf("invalid throttle for device %s: must not be negative", limit.Device))
+		}
+	}
+	return nil
+}
+
+// Returns the cgroup (v1) settings implementing the resources, keyed by
+// controller file (e.g. "memory.limit_in_bytes").
+func (this *Resources) GetCgroupV1Settings() map[string][]string {
+	settings := make(map[string][]string)
+	if this.Memory != 0 {
+		settings["memory.limit_in_bytes"] = []string{strconv.FormatInt(this.Memory, 10)}
+		if this.Swap != 0 {
+			settings["memory.memsw.limit_in_bytes"] = []string{strconv.FormatInt(this.Memory+this.Swap, 10)}
+		}
+	}
+	if this.Cpu_shares != 0 {
+		settings["cpu.shares"] = []string{strconv.Itoa(this.Cpu_shares)}
+	}
+	if this.Cpus != 0 {
+		settings["cpu.cfs_period_us"] = []string{strconv.FormatInt(CPU_PERIOD_US, 10)}
+		settings["cpu.cfs_quota_us"] = []string{strconv.FormatInt(int64(this.Cpus*float64(CPU_PERIOD_US)), 10)}
+	}
+	if this.Cpuset != "" {
+		settings["cpuset.cpus"] = []string{this.Cpuset}
+	}
+	if this.Blkio_weight != 0 {
+		settings["blkio.weight"] = []string{strconv.Itoa(this.Blkio_weight)}
+	}
+	for _, limit := range this.Blkio_devices {
+		for file, value := range map[string]int64{
+			"blkio.weight_device": int64(limit.Weight),
+			"blkio.throttle.read_bps_device": limit.Read_bps,
+			"blkio.throttle.write_bps_device": limit.Write_bps,
+			"blkio.throttle.read_iops_device": limit.Read_iops,
+			"blkio.throttle.write_iops_device": limit.Write_iops} {
+			if value != 0 {
+				settings[file] = append(settings[file], fmt.Sprintf("%s %d", limit.Device, value))
+			}
+		}
+	}
+	if this.Pids != 0 {
+		settings["pids.max"] = []string{strconv.FormatInt(this.Pids, 10)}
+	}
+	return settings
+}
+
+// Returns a copy of a configuration map with the resources’ cgroup keys
+// set. Resources override keys of the map that configure the same
+// setting.
+//
+// @param info The configuration map.
+// @param version The host’s cgroup version (see GetHostCgroupVersion).
+func (this *Resources) ApplyTo(info CgroupInfo, version int) (CgroupInfo, error) {
+	if version == 2 {
+		result, err := TranslateCgroupInfoToV2(info)
+		if err != nil {
+			return nil, err
+		}
+		settings, err := this.GetCgroupV2Settings()
+		if err != nil {
+			return nil, err
+		}
+		for file, values := range settings {
+			result["lxc.cgroup2."+file] = values
+		}
+		return result, nil
+	}
+	result := make(CgroupInfo)
+	for key, values := range info {
+		result[key] = values
+	}
+	for file, values := range this.GetCgroupV1Settings() {
+		result["lxc.cgroup."+file] = values
+	}
+	return result, nil
+}
+
+// Returns the cgroup settings implementing the resources for a cgroup
+// version, keyed by controller file.
+func (this *Resources) GetCgroupSettings(version int) (map[string][]string, error) {
+	if version == 2 {
+		return this.GetCgroupV2Settings()
+	}
+	return this.GetCgroupV1Settings(), nil
+}
+
+// Returns the resources in their human readable form, one setting=value
+// per element, in the order of GetResourceSettingNames.
+func (this *Resources) GetSettingStrings() []string {
+	settings := make([]string, 0)
+	if this.Memory != 0 {
+		settings = append(settings, "memory="+FormatByteSize(this.Memory))
+	}
+	if this.Swap != 0 {
+		settings = append(settings, "swap="+FormatByteSize(this.Swap))
+	}
+	if this.Cpu_shares != 0 {
+		settings = append(settings, fmt.Sprintf("cpu-shares=%d", this.Cpu_shares))
+	}
+	if this.Cpus != 0 {
+		settings = append(settings, fmt.Sprintf("cpus=%g", this.Cpus))
+	}
+	if this.Cpuset != "" {
+		settings = append(settings, "cpuset="+this.Cpuset)
+	}
+	if this.Blkio_weight != 0 {
+		settings = append(settings, fmt.Sprintf("blkio-weight=%d", this.Blkio_weight))
+	}
+	devices := make([]string, 0)
+	for _, limit := range this.Blkio_devices {
+		for _, setting := range []struct {
+			name string
+			value int64
+		}{{"blkio-weight-device", int64(limit.Weight)}, {"read-bps", limit.Read_bps},
+			{"write-bps", limit.Write_bps}, {"read-iops", limit.Read_iops}, {"write-iops", limit.Write_iops}} {
+			if setting.value != 0 {
+				devices = append(devices, fmt.Sprintf("%s=%s:%d", setting.name, limit.Device, setting.value))
+			}
+		}
+	}
+	sort.Strings(devices)
+	settings = append(settings, devices...)
+	if this.Pids != 0 {
+		settings = append(settings, fmt.Sprintf("pids=%d", this.Pids))
+	}
+	return settings
+}
+
+// Returns the configuration of a container rendered with its resources
+// for the host’s cgroup version.
+//
+// @param info The configuration map.
+// @param resources The resources of the container.
+func GetCgroupInfoBytesWithResources(info CgroupInfo, resources *Resources) ([]byte, error) {
+	if err := resources.Validate(); err != nil {
+		return nil, err
+	}
+	result, err := resources.ApplyTo(info, GetHostCgroupVersion())
+	if err != nil {
+		return nil, err
+	}
+	return GetCgroupInfoBytes(result)
+}
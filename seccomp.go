@@ -0,0 +1,166 @@
+/// File: seccomp.go
+/// Purpose: Renders a container’s syscall filter into the LXC seccomp
+/// policy file referenced by lxc.seccomp.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+)
+
+// Matches syscall names (e.g. "open_by_handle_at").
+var syscall_name_regexp = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+
+// Describes the syscalls a container may make.
+type SeccompProfile struct {
+
+	/* The action for syscalls not listed: "allow", "deny", or "" to
+	   filter no syscalls. */
+	Default_action string;
+
+	/* The syscalls allowed when the default action is "deny". */
+	Allow []string;
+
+	/* The syscalls denied when the default action is "allow". */
+	Deny []string;
+
+	/* The error number denied syscalls fail with, or 0 to kill the
+	   process making them. */
+	Errno int;
+}
+
+// Returns the default seccomp profile, which allows all syscalls except
+// those that load kernel code, reach host files through handles, change
+// the host’s swap or I/O ports, or use the host’s keyrings.
+func NewDefaultSeccompProfile() SeccompProfile {
+	return SeccompProfile{"allow", []string{}, []string{"kexec_load", "kexec_file_load",
+		"open_by_handle_at", "init_module", "finit_module", "delete_module", "iopl",
+		"ioperm", "swapon", "swapoff", "acct", "add_key", "request_key", "keyctl"}, 1}
+}
+
+// Returns nil iff the profile is well-formed.
+func (this *SeccompProfile) Validate() error {
+	if this.Default_action != "" && this.Default_action != "allow" && this.Default_action != "deny" {
+		return errors.New(fmt.Sprintf("invalid seccomp default action ’%s’: expected allow or deny", this.Default_action))
+	}
+	for _, names := range [][]string{this.Allow, this.Deny} {
+		for _, name := range names {
+			if !syscall_name_regexp.MatchString(name) {
+				return errors.New(fmt.Sprintf("invalid syscall name ’%s’", name))
+			}
+		}
+	}
+	if this.Default_action == "deny" && len(this.Allow) == 0 {
+		return errors.New("a seccomp profile denying by default must allow some syscalls")
+	}
+	if this.Errno < 0 || this.Errno > 4095 {
+		return errors.New(fmt.Sprintf("invalid seccomp errno %d", this.Errno))
+	}
+	return nil
+}
+
+// Lists a syscall in one list of the profile and removes it from the
+// other. Returns false iff it was already listed.
+//
+// @param name The name of the syscall.
+// @param allow Whether to allow (rather than deny) the syscall.
+func (this *SeccompProfile) SetSyscall(name string, allow bool) (bool, error) {
+	if !syscall_name_regexp.MatchString(name) {
+		return false, errors.New(fmt.Sprintf("invalid syscall name ’%s’", name))
+	}
+	add, remove := &this.Deny, &this.Allow
+	if allow {
+		add, remove = &this.Allow, &this.Deny
+	}
+	for i, existing := range *remove {
+		if existing == name {
+			*remove = append((*remove)[:i], (*remove)[i+1:]...)
+			break
+		}
+	}
+	for _, existing := range *add {
+		if existing == name {
+			return false, nil
+		}
+	}
+	*add = append(*add, name)
+	return true, nil
+}
+
+// Returns the action of denied syscalls in the LXC policy syntax.
+func (this *SeccompProfile) GetDenyAction() string {
+	if this.Errno == 0 {
+		return "kill"
+	}
+	return fmt.Sprintf("errno %d", this.Errno)
+}
+
+// Returns the profile in the version 2 LXC seccomp policy format: a
+// whitelist whose unlisted syscalls get the deny action, or a blacklist
+// whose listed syscalls do.
+func (this *SeccompProfile) GetPolicyBytes() ([]byte, error) {
+	if err := this.Validate(); err != nil {
+		return nil, err
+	}
+	policy := "2\n"
+	if this.Default_action == "deny" {
+		policy += "whitelist " + this.GetDenyAction() + "\n[all]\n"
+		for _, name := range this.Allow {
+			policy += name + "\n"
+		}
+	} else {
+		policy += "blacklist\n[all]\n"
+		for _, name := range this.Deny {
+			policy += name + " " + this.GetDenyAction() + "\n"
+		}
+	}
+	return []byte(policy), nil
+}
+
+// Returns a one-line description of the profile for ’inspect’.
+func (this *SeccompProfile) String() string {
+	switch this.Default_action {
+	case "allow":
+		return fmt.Sprintf("default allow, %d denied (%s)", len(this.Deny), this.GetDenyAction())
+	case "deny":
+		return fmt.Sprintf("default deny (%s), %d allowed", this.GetDenyAction(), len(this.Allow))
+	}
+	return "off"
+}
+
+// Returns the pathname of the container’s seccomp policy file.
+func (this *Container) GetSeccompPathname() string {
+	return path.Join(this.cdir, "seccomp")
+}
+
+// Writes the container’s seccomp policy file, or removes it if the
+// profile filters no syscalls, and returns a copy of an LXC
+// configuration referencing it.
+func (this *Container) WriteSeccompPolicy(info CgroupInfo) (CgroupInfo, error) {
+	result := make(CgroupInfo)
+	for key, values := range info {
+		if key != "lxc.seccomp" {
+			result[key] = values
+		}
+	}
+	if this.Spec.Seccomp.Default_action == "" {
+		if err := os.Remove(this.GetSeccompPathname()); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return result, nil
+	}
+	policy_bytes, err := this.Spec.Seccomp.GetPolicyBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(this.GetSeccompPathname(), policy_bytes, 0644); err != nil {
+		return nil, err
+	}
+	result["lxc.seccomp"] = []string{this.GetSeccompPathname()}
+	return result, nil
+}
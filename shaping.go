@@ -0,0 +1,136 @@
+/// File: shaping.go
+/// Purpose: Limits the bandwidth of a running container using tc on the
+/// host end of its veth pair.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// Matches the rates accepted by tc (e.g. "10mbit", "512kbit", "1gbps").
+var rate_pattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([kmgt]?bit|[kmgt]?bps)$`)
+
+// Describes the bandwidth a container may use, as seen from inside the
+// container. A rate of "" means unlimited.
+type BandwidthLimits struct {
+
+	/* The rate of traffic sent by the container (e.g. "10mbit"). */
+	Egress string;
+
+	/* The rate of traffic received by the container. */
+	Ingress string;
+}
+
+// Returns nil iff a rate is "" or in a form accepted by tc.
+func ValidateRate(rate string) error {
+	if rate != "" && !rate_pattern.MatchString(rate) {
+		return errors.New(fmt.Sprintf("invalid rate ’%s’: expected e.g. 10mbit, 512kbit, or 1gbps", rate))
+	}
+	return nil
+}
+
+// Returns nil iff both rates are well-formed.
+func (this BandwidthLimits) Validate() error {
+	if err := ValidateRate(this.Egress); err != nil {
+		return err
+	}
+	return ValidateRate(this.Ingress)
+}
+
+// Returns true iff neither direction is limited.
+func (this BandwidthLimits) IsUnlimited() bool {
+	return this.Egress == "" && this.Ingress == ""
+}
+
+// Returns the limits in a human readable form.
+func (this BandwidthLimits) String() string {
+	egress, ingress := this.Egress, this.Ingress
+	if egress == "" {
+		egress = "unlimited"
+	}
+	if ingress == "" {
+		ingress = "unlimited"
+	}
+	return fmt.Sprintf("egress %s ingress %s", egress, ingress)
+}
+
+// Returns the tc commands enforcing the limits on a host-side veth. The
+// host end sends what the container receives, so the container’s ingress
+// is shaped with a root token bucket and its egress is policed on the
+// host end’s ingress qdisc.
+//
+// @param limits The limits to enforce.
+// @param veth The name of the host end of the veth pair.
+func GetRateLimitCommands(limits BandwidthLimits, veth string) [][]string {
+	commands := make([][]string, 0)
+	if limits.Ingress != "" {
+		commands = append(commands, []string{"qdisc", "replace", "dev", veth, "root",
+			"tbf", "rate", limits.Ingress, "burst", "64kb", "latency", "400ms"})
+	}
+	if limits.Egress != "" {
+		commands = append(commands,
+			[]string{"qdisc", "replace", "dev", veth, "handle", "ffff:", "ingress"},
+			[]string{"filter", "replace", "dev", veth, "parent", "ffff:", "protocol", "all",
+				"u32", "match", "u32", "0", "0", "police", "rate", limits.Egress,
+				"burst", "64kb", "drop", "flowid", ":1"})
+	}
+	return commands
+}
+
+// Returns the host end of the veth pair of the container’s primary
+// interface, which carries the container’s leased address.
+func (this *Container) GetPrimaryVethPair() (string, error) {
+	primary := GetPrimaryInterfaceIndex(this.Spec.Networks)
+	if primary == -1 || this.Spec.Networks[primary].Mode != "veth" {
+		return "", errors.New(fmt.Sprintf("container ’%s’ has no veth interface - cannot limit its bandwidth", this.name))
+	}
+	veth := this.Spec.Networks[primary].Veth_pair
+	if veth == "" {
+		return "", errors.New(fmt.Sprintf("the veth pair of container ’%s’ has no name (remount it)", this.name))
+	}
+	return veth, nil
+}
+
+// Removes any rate limits from the container’s host-side veth and applies
+// those of its specification. Called when the container starts and when
+// its limits change while it runs.
+func (this *Container) InstallRateLimits() error {
+	if err := this.Spec.Bandwidth.Validate(); err != nil {
+		return err
+	}
+	if this.Spec.Bandwidth.IsUnlimited() {
+		return this.RemoveRateLimits()
+	}
+	veth, err := this.GetPrimaryVethPair()
+	if err != nil {
+		return err
+	}
+	if err = this.RemoveRateLimits(); err != nil {
+		return err
+	}
+	for _, args := range GetRateLimitCommands(this.Spec.Bandwidth, veth) {
+		if err = RunCommand("tc", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the rate limits from the container’s host-side veth. Nothing is
+// done if the veth no longer exists, e.g. once the container has stopped.
+func (this *Container) RemoveRateLimits() error {
+	veth, err := this.GetPrimaryVethPair()
+	if err != nil || !DirExists(path.Join("/sys/class/net", veth)) {
+		return nil
+	}
+	// tc fails when deleting a qdisc that does not exist, so errors are
+	// ignored.
+	for _, qdisc := range []string{"root", "ingress"} {
+		RunCommand("tc", "qdisc", "del", "dev", veth, qdisc)
+	}
+	return nil
+}
@@ -0,0 +1,426 @@
+/// File: snapshot.go
+/// Purpose: Takes, lists, rolls back, and prunes point-in-time snapshots
+/// of a container’s private data (the writable AUFS branch).
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The format of labels given to snapshots taken without an explicit label.
+const SNAPSHOT_AUTO_LABEL_FORMAT string = "20060102-150405"
+
+// Describes how many automatic snapshots to keep when pruning. The newest
+// snapshot of each of the last Hourly hours and of each of the last Daily
+// days is kept. When both are zero, pruning is disabled.
+type RetentionPolicy struct {
+
+	/* The number of distinct hours to keep a snapshot for. */
+	Hourly int;
+
+	/* The number of distinct days to keep a snapshot for. */
+	Daily int;
+}
+
+// Describes a snapshot of a container’s private data.
+type Snapshot struct {
+
+	/* The label of the snapshot, unique within the container. */
+	Label string;
+
+	/* When the snapshot was taken. */
+	Created time.Time;
+
+	/* Whether the label was generated (and the snapshot is therefore
+	   subject to the retention policy). */
+	Automatic bool;
+
+	/* The directory holding the snapshot. */
+	sdir string;
+}
+
+// Returns true iff a snapshot label is safe to use as a directory name.
+func IsValidSnapshotLabel(label string) bool {
+	if label == "" || label == "." || label == ".." {
+		return false
+	}
+	for _, c := range label {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the directory where the snapshots of this container are stored.
+func (this *Container) GetSnapshotsDirectory() string {
+	return path.Join(this.cdir, "snapshots")
+}
+
+// Takes a snapshot of the container’s private data. Files unchanged since
+// the most recent snapshot are hard-linked to it rather than copied.
+//
+// @param label The label of the snapshot. When empty, a label is generated
+// from the current time and the snapshot is subject to pruning.
+func (this *Container) Snapshot(label string) (*Snapshot, error) {
+	if !this.IsCreated() {
+		return nil, errors.New("container " + this.name + " has not yet been created")
+	}
+	now := time.Now()
+	automatic := label == ""
+	if automatic {
+		label = now.Format(SNAPSHOT_AUTO_LABEL_FORMAT)
+	}
+	if !IsValidSnapshotLabel(label) {
+		return nil, errors.New(fmt.Sprintf("invalid snapshot label ’%s’: only letters, digits, ’-’, ’_’, and ’.’ are allowed", label))
+	}
+	snapshots, err := this.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	sdir := path.Join(this.GetSnapshotsDirectory(), label)
+	if FileExists(sdir) {
+		return nil, errors.New(fmt.Sprintf("snapshot ’%s’ of container ’%s’ already exists", label, this.name))
+	}
+	err = os.MkdirAll(this.GetSnapshotsDirectory(), 0700)
+	if err != nil {
+		return nil, err
+	}
+	// Build the snapshot under a temporary name so that an interrupted
+	// snapshot is never mistaken for a complete one.
+	tmp_dir := sdir + ".partial"
+	os.RemoveAll(tmp_dir)
+	err = os.Mkdir(tmp_dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	link_dir := ""
+	if len(snapshots) > 0 {
+		link_dir = path.Join(snapshots[len(snapshots)-1].sdir, "private-data")
+	}
+	err = CopyTreeLinkingUnchanged(this.private_dir, path.Join(tmp_dir, "private-data"), link_dir)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(tmp_dir, "created"),
+			[]byte(strconv.FormatInt(now.Unix(), 10)), 0644)
+	}
+	if err == nil && automatic {
+		err = ioutil.WriteFile(path.Join(tmp_dir, "automatic"), []byte{}, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp_dir, sdir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp_dir)
+		return nil, err
+	}
+	return &Snapshot{label, now, automatic, sdir}, nil
+}
+
+// Returns the snapshots of this container ordered from oldest to newest.
+func (this *Container) ListSnapshots() ([]*Snapshot, error) {
+	snapshots := make([]*Snapshot, 0)
+	if !DirExists(this.GetSnapshotsDirectory()) {
+		return snapshots, nil
+	}
+	entries, err := ioutil.ReadDir(this.GetSnapshotsDirectory())
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasSuffix(entry.Name(), ".partial") {
+			continue
+		}
+		sdir := path.Join(this.GetSnapshotsDirectory(), entry.Name())
+		created_bytes, err := ioutil.ReadFile(path.Join(sdir, "created"))
+		if err != nil {
+			return nil, err
+		}
+		created, err := strconv.ParseInt(strings.TrimSpace(string(created_bytes)), 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("snapshot ’%s’ has a corrupt creation time", entry.Name()))
+		}
+		snapshots = append(snapshots, &Snapshot{entry.Name(),
+			time.Unix(created, 0),
+			FileExists(path.Join(sdir, "automatic")),
+			sdir})
+	}
+	sort.Sort(snapshotsByCreation(snapshots))
+	return snapshots, nil
+}
+
+// Returns the snapshot of this container with a given label.
+func (this *Container) GetSnapshot(label string) (*Snapshot, error) {
+	snapshots, err := this.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Label == label {
+			return snapshot, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("container ’%s’ has no snapshot ’%s’", this.name, label))
+}
+
+// Replaces the container’s private data with the contents of a snapshot.
+// The container must not be running. If it is mounted, it is unmounted
+// during the rollback and mounted again afterwards.
+//
+// @param label The label of the snapshot to roll back to.
+func (this *Container) Rollback(label string) error {
+	if this.IsRunning() {
+		return errors.New("container " + this.name + " is running - stop it before rolling back")
+	}
+	snapshot, err := this.GetSnapshot(label)
+	if err != nil {
+		return err
+	}
+	// Copy rather than link: the rolled back data will be modified and
+	// must not write through to the snapshot.
+	new_private_dir := this.private_dir + ".rollback"
+	old_private_dir := this.private_dir + ".old"
+	os.RemoveAll(new_private_dir)
+	err = CopyTreeLinkingUnchanged(path.Join(snapshot.sdir, "private-data"), new_private_dir, "")
+	if err != nil {
+		os.RemoveAll(new_private_dir)
+		return err
+	}
+	was_mounted := this.IsMounted()
+	if was_mounted {
+		err = this.Unmount()
+		if err != nil {
+			os.RemoveAll(new_private_dir)
+			return err
+		}
+	}
+	err = os.Rename(this.private_dir, old_private_dir)
+	if err == nil {
+		err = os.Rename(new_private_dir, this.private_dir)
+		if err != nil {
+			os.Rename(old_private_dir, this.private_dir)
+		}
+	}
+	if was_mounted {
+		mount_err := this.Mount()
+		if err == nil {
+			err = mount_err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(old_private_dir)
+}
+
+// Deletes a snapshot of this container.
+//
+// @param label The label of the snapshot to delete.
+func (this *Container) DeleteSnapshot(label string) error {
+	snapshot, err := this.GetSnapshot(label)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(snapshot.sdir)
+}
+
+// Deletes the automatic snapshots that fall outside the container’s
+// retention policy and returns them. Snapshots taken with an explicit
+// label are never pruned.
+func (this *Container) PruneSnapshots() ([]*Snapshot, error) {
+	pruned := make([]*Snapshot, 0)
+	policy := this.Spec.Snapshot_retention
+	if policy.Hourly <= 0 && policy.Daily <= 0 {
+		return pruned, nil
+	}
+	snapshots, err := this.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	automatic := make([]*Snapshot, 0)
+	for _, snapshot := range snapshots {
+		if snapshot.Automatic {
+			automatic = append(automatic, snapshot)
+		}
+	}
+	keep := make(map[string]bool)
+	KeepNewestPerPeriod(automatic, "2006010215", policy.Hourly, keep)
+	KeepNewestPerPeriod(automatic, "20060102", policy.Daily, keep)
+	for _, snapshot := range automatic {
+		if keep[snapshot.Label] {
+			continue
+		}
+		err = os.RemoveAll(snapshot.sdir)
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, snapshot)
+	}
+	return pruned, nil
+}
+
+// Marks the newest snapshot of each of the most recent ’count’ periods as
+// kept. A period is identified by formatting the creation time with
+// ’period_format’, so "20060102" yields one period per day.
+//
+// @param snapshots The snapshots ordered from oldest to newest.
+// @param period_format A time layout identifying the period.
+// @param count The number of periods to keep.
+// @param keep The set of labels to keep, updated in place.
+func KeepNewestPerPeriod(snapshots []*Snapshot, period_format string, count int, keep map[string]bool) {
+	last_period := ""
+	for i := len(snapshots) - 1; i >= 0 && count > 0; i-- {
+		period := snapshots[i].Created.Format(period_format)
+		if period != last_period {
+			keep[snapshots[i].Label] = true
+			last_period = period
+			count--
+		}
+	}
+}
+
+// Sorts snapshots from oldest to newest.
+type snapshotsByCreation []*Snapshot
+
+func (this snapshotsByCreation) Len() int {
+	return len(this)
+}
+
+func (this snapshotsByCreation) Less(i, j int) bool {
+	if this[i].Created.Equal(this[j].Created) {
+		return this[i].Label < this[j].Label
+	}
+	return this[i].Created.Before(this[j].Created)
+}
+
+func (this snapshotsByCreation) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
+
+// Recursively copies a directory tree preserving modes, ownership, and
+// modification times. When ’link_dir’ is given, regular files that are
+// unchanged relative to the same path under ’link_dir’ (same size, mode,
+// owner, and modification time) are hard-linked instead of copied.
+//
+// @param src_dir The directory to copy.
+// @param dest_dir The directory to create; it must not exist.
+// @param link_dir A previous copy to link unchanged files to, or "".
+func CopyTreeLinkingUnchanged(src_dir string, dest_dir string, link_dir string) error {
+	// Directory modification times change as entries are added, so they
+	// are restored once the walk is complete.
+	dir_times := make(map[string]time.Time)
+	err := filepath.Walk(src_dir, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src_dir, src)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dest_dir, rel)
+		mode := info.Mode()
+		stat, _ := info.Sys().(*syscall.Stat_t)
+		switch {
+		case mode.IsDir():
+			err = os.Mkdir(dest, 0700)
+			dir_times[dest] = info.ModTime()
+		case mode&os.ModeSymlink != 0:
+			var target string
+			target, err = os.Readlink(src)
+			if err == nil {
+				err = os.Symlink(target, dest)
+			}
+			if err == nil && stat != nil {
+				err = os.Lchown(dest, int(stat.Uid), int(stat.Gid))
+			}
+			return err
+		case mode.IsRegular():
+			if link_dir != "" && IsUnchangedFile(filepath.Join(link_dir, rel), info) {
+				return os.Link(filepath.Join(link_dir, rel), dest)
+			}
+			err = CopyRegularFile(src, dest)
+		default:
+			// Devices, FIFOs, and sockets are rare in private data;
+			// let cp deal with them.
+			var out []byte
+			out, err = exec.Command("cp", "-a", src, dest).CombinedOutput()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "stdout+stderr> %s", out)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if stat != nil {
+			err = os.Lchown(dest, int(stat.Uid), int(stat.Gid))
+			if err != nil {
+				return err
+			}
+		}
+		// Chmod after chown since chown clears the setuid and setgid bits.
+		err = os.Chmod(dest, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(dest, info.ModTime(), info.ModTime())
+	})
+	if err != nil {
+		return err
+	}
+	for dir, mtime := range dir_times {
+		os.Chtimes(dir, mtime, mtime)
+	}
+	return nil
+}
+
+// Returns true iff ’pathname’ is a regular file whose size, mode, owner,
+// and modification time match ’info’.
+func IsUnchangedFile(pathname string, info os.FileInfo) bool {
+	other, err := os.Lstat(pathname)
+	if err != nil || !other.Mode().IsRegular() {
+		return false
+	}
+	if other.Size() != info.Size() || other.Mode() != info.Mode() ||
+		!other.ModTime().Equal(info.ModTime()) {
+		return false
+	}
+	stat, ok1 := info.Sys().(*syscall.Stat_t)
+	other_stat, ok2 := other.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 {
+		return stat.Uid == other_stat.Uid && stat.Gid == other_stat.Gid
+	}
+	return true
+}
+
+// Copies the contents of a regular file into a new file.
+func CopyRegularFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	close_err := out.Close()
+	if err != nil {
+		return err
+	}
+	return close_err
+}
@@ -0,0 +1,131 @@
+/// File: spec.go
+/// Purpose: Stores the per-container specification, the settings that
+/// must outlive a single qb invocation (e.g. snapshot retention).
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+)
+
+// Encapsulates the persistent settings of a container. The specification
+// is stored as JSON in <cdir>/meta/spec and is loaded whenever a container
+// object is constructed from its meta-data.
+type ContainerSpec struct {
+
+	/* How many automatic snapshots the ’snapshot-prune’ pass keeps. */
+	Snapshot_retention RetentionPolicy;
+
+	/* The static IPv4 address with prefix length (e.g. "10.0.3.5/24")
+	   leased to the container, or "" to use DHCP. */
+	Ipv4 string;
+
+	/* The IPv4 gateway of the container, or "" for none. */
+	Ipv4_gateway string;
+
+	/* The IPv6 address with prefix length leased to the container, or ""
+	   if the host configures no IPv6 prefix. */
+	Ipv6 string;
+
+	/* The IPv6 gateway of the container, or "" for none. */
+	Ipv6_gateway string;
+
+	/* The firewall rendered into the container’s /root/iptables.conf. */
+	Firewall FirewallPolicy;
+
+	/* The host ports forwarded to the container while it runs. */
+	Ports []PortMapping;
+
+	/* The network interfaces of the container in the order they are
+	   rendered into the LXC configuration. */
+	Networks []NetworkInterface;
+
+	/* The rate limits applied to the container’s host-side veth while
+	   it runs. */
+	Bandwidth BandwidthLimits;
+
+	/* The group of the container, or "" for none. Members of a group
+	   find each other’s names and static addresses in /etc/hosts. */
+	Group string;
+
+	/* The resources the container may use, rendered into its LXC
+	   configuration. */
+	Resources Resources;
+
+	/* The devices the container may access. */
+	Devices DevicePolicy;
+
+	/* The capabilities the container loses. */
+	Capabilities CapabilityProfile;
+
+	/* The syscalls the container may make. */
+	Seccomp SeccompProfile;
+
+	/* How the container’s uids and gids map to host ids if it runs in a
+	   user namespace. */
+	Userns IdMap;
+}
+
+// Returns the pathname of the specification file given a container’s
+// meta-data directory.
+func GetContainerSpecPathname(meta_dir string) string {
+	return path.Join(meta_dir, "spec")
+}
+
+// Returns a new specification holding the default settings.
+func NewDefaultContainerSpec() *ContainerSpec {
+	return &ContainerSpec{
+		RetentionPolicy{0, 0},
+		"",
+		"",
+		"",
+		"",
+		NewDefaultFirewallPolicy(),
+		[]PortMapping{},
+		NewDefaultNetworkInterfaces(),
+		BandwidthLimits{"", ""},
+		"",
+		Resources{},
+		NewDefaultDevicePolicy(),
+		NewDefaultCapabilityProfile(),
+		NewDefaultSeccompProfile(),
+		IdMap{0, 0, 0},
+	}
+}
+
+// Loads a container specification from a meta-data directory. Containers
+// created before specifications existed have no spec file, in which case
+// the default specification is returned.
+//
+// @param meta_dir The meta-data directory of the container.
+func LoadContainerSpec(meta_dir string) (*ContainerSpec, error) {
+	spec := NewDefaultContainerSpec()
+	spec_pathname := GetContainerSpecPathname(meta_dir)
+	if !FileExists(spec_pathname) {
+		return spec, nil
+	}
+	spec_bytes, err := ioutil.ReadFile(spec_pathname)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(spec_bytes, spec)
+	if err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// Saves the specification into a meta-data directory. The file is
+// written to a temporary name first and renamed so a crash never leaves
+// a truncated spec behind.
+//
+// @param meta_dir The meta-data directory of the container.
+func (this *ContainerSpec) Save(meta_dir string) error {
+	spec_bytes, err := json.MarshalIndent(this, "", "\t")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(GetContainerSpecPathname(meta_dir), append(spec_bytes, '\n'), 0644)
+}
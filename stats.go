@@ -0,0 +1,245 @@
+/// File: stats.go
+/// Purpose: Reports the resource usage of containers from their cgroup
+/// files.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cgroup v1 reports an unlimited memory limit as a value near 2^63.
+const CGROUP_V1_UNLIMITED uint64 = 1 << 62
+
+// Describes the block I/O of a container on one device.
+type BlkioDeviceStats struct {
+
+	/* The device as MAJOR:MINOR. */
+	Device string;
+
+	Read_bytes uint64;
+	Write_bytes uint64;
+	Read_ops uint64;
+	Write_ops uint64;
+}
+
+// Describes the resource usage of a container at one point in time.
+type ContainerStats struct {
+	Name string;
+
+	/* When the statistics were read (seconds since the epoch). */
+	Time int64;
+
+	Running bool;
+
+	/* The memory in use and its limit in bytes (0 if unlimited). */
+	Memory_usage uint64;
+	Memory_limit uint64;
+
+	/* How often the memory limit was hit. */
+	Memory_failcnt uint64;
+
+	/* The CPU time used in nanoseconds. */
+	Cpu_usage uint64;
+
+	/* The block I/O per device. */
+	Blkio []BlkioDeviceStats;
+
+	/* The number of tasks (processes and threads). */
+	Tasks uint64;
+
+	/* The cumulative network traffic (see CollectTraffic). */
+	Network TrafficCounters;
+}
+
+// Reads a cgroup file holding a number. "max" is read as 0.
+func (this *Container) ReadCgroupUint(file string) (uint64, error) {
+	value, err := this.ReadCgroupFile(file)
+	if err != nil {
+		return 0, err
+	}
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// Reads a cgroup file of ’key value’ lines (e.g. memory.events) and
+// returns the value of one key.
+func (this *Container) ReadCgroupKeyedUint(file string, key string) (uint64, error) {
+	value, err := this.ReadCgroupFile(file)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, nil
+}
+
+// Returns the block I/O statistics for a device, adding them if absent.
+func GetBlkioDeviceStats(devices *[]BlkioDeviceStats, device string) *BlkioDeviceStats {
+	for i := range *devices {
+		if (*devices)[i].Device == device {
+			return &(*devices)[i]
+		}
+	}
+	*devices = append(*devices, BlkioDeviceStats{Device: device})
+	return &(*devices)[len(*devices)-1]
+}
+
+// Parses cgroup v1 blkio.throttle.io_service_bytes or io_serviced, whose
+// lines have the form ’MAJOR:MINOR Read|Write|... VALUE’.
+//
+// @param content The content of the file.
+// @param bytes Whether the file counts bytes (otherwise operations).
+// @param devices The statistics to add to.
+func ParseBlkioV1Stats(content string, bytes bool, devices *[]BlkioDeviceStats) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || (fields[1] != "Read" && fields[1] != "Write") {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats := GetBlkioDeviceStats(devices, fields[0])
+		switch {
+		case bytes && fields[1] == "Read":
+			stats.Read_bytes = value
+		case bytes:
+			stats.Write_bytes = value
+		case fields[1] == "Read":
+			stats.Read_ops = value
+		default:
+			stats.Write_ops = value
+		}
+	}
+}
+
+// Parses cgroup v2 io.stat, whose lines have the form
+// ’MAJOR:MINOR rbytes=N wbytes=N rios=N wios=N ...’.
+func ParseIOStatV2(content string) []BlkioDeviceStats {
+	devices := make([]BlkioDeviceStats, 0)
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		stats := GetBlkioDeviceStats(&devices, fields[0])
+		for _, field := range fields[1:] {
+			pair := strings.SplitN(field, "=", 2)
+			if len(pair) != 2 {
+				continue
+			}
+			value, err := strconv.ParseUint(pair[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch pair[0] {
+			case "rbytes":
+				stats.Read_bytes = value
+			case "wbytes":
+				stats.Write_bytes = value
+			case "rios":
+				stats.Read_ops = value
+			case "wios":
+				stats.Write_ops = value
+			}
+		}
+	}
+	return devices
+}
+
+// Returns the resource usage of the container. A container that is not
+// running only reports its cumulative network traffic.
+func (this *Container) Stats() (*ContainerStats, error) {
+	stats := &ContainerStats{Name: this.name, Time: time.Now().Unix(), Blkio: []BlkioDeviceStats{}}
+	traffic, err := this.CollectTraffic()
+	if err != nil {
+		return nil, err
+	}
+	stats.Network = traffic.Total
+	if _, err := this.GetCgroupDirectory("memory"); err != nil {
+		return stats, nil
+	}
+	stats.Running = true
+	if GetHostCgroupVersion() == 2 {
+		err = this.ReadCgroupV2Stats(stats)
+	} else {
+		err = this.ReadCgroupV1Stats(stats)
+	}
+	return stats, err
+}
+
+// Reads the statistics of a container from cgroup v1 files.
+func (this *Container) ReadCgroupV1Stats(stats *ContainerStats) error {
+	var err error
+	if stats.Memory_usage, err = this.ReadCgroupUint("memory.usage_in_bytes"); err != nil {
+		return err
+	}
+	if stats.Memory_limit, err = this.ReadCgroupUint("memory.limit_in_bytes"); err != nil {
+		return err
+	}
+	if stats.Memory_limit >= CGROUP_V1_UNLIMITED {
+		stats.Memory_limit = 0
+	}
+	if stats.Memory_failcnt, err = this.ReadCgroupUint("memory.failcnt"); err != nil {
+		return err
+	}
+	if stats.Cpu_usage, err = this.ReadCgroupUint("cpuacct.usage"); err != nil {
+		return err
+	}
+	for _, file := range []string{"blkio.throttle.io_service_bytes", "blkio.throttle.io_serviced"} {
+		content, err := this.ReadCgroupFile(file)
+		if err != nil {
+			return err
+		}
+		ParseBlkioV1Stats(content, file == "blkio.throttle.io_service_bytes", &stats.Blkio)
+	}
+	// The tasks file belongs to no controller.
+	dir, err := this.GetCgroupDirectory("cpuacct")
+	if err != nil {
+		return err
+	}
+	tasks, err := ioutil.ReadFile(path.Join(dir, "tasks"))
+	if err != nil {
+		return err
+	}
+	stats.Tasks = uint64(len(strings.Fields(string(tasks))))
+	return nil
+}
+
+// Reads the statistics of a container from cgroup v2 files.
+func (this *Container) ReadCgroupV2Stats(stats *ContainerStats) error {
+	var err error
+	if stats.Memory_usage, err = this.ReadCgroupUint("memory.current"); err != nil {
+		return err
+	}
+	if stats.Memory_limit, err = this.ReadCgroupUint("memory.max"); err != nil {
+		return err
+	}
+	if stats.Memory_failcnt, err = this.ReadCgroupKeyedUint("memory.events", "max"); err != nil {
+		return err
+	}
+	usage_usec, err := this.ReadCgroupKeyedUint("cpu.stat", "usage_usec")
+	if err != nil {
+		return err
+	}
+	stats.Cpu_usage = usage_usec * 1000
+	io_stat, err := this.ReadCgroupFile("io.stat")
+	if err != nil {
+		return err
+	}
+	stats.Blkio = ParseIOStatV2(io_stat)
+	stats.Tasks, err = this.ReadCgroupUint("pids.current")
+	return err
+}
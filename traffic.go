@@ -0,0 +1,215 @@
+/// File: traffic.go
+/// Purpose: Accounts for the network traffic of containers so tenants can
+/// be billed by traffic. Totals survive container restarts.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Describes the traffic of a container as seen from inside the container.
+type TrafficCounters struct {
+	Rx_bytes uint64;
+	Rx_packets uint64;
+	Tx_bytes uint64;
+	Tx_packets uint64;
+
+	/* The bytes received through each forwarded port, keyed by the port
+	   mapping (e.g. "8080:80/tcp"). */
+	Forwarded_bytes map[string]uint64;
+}
+
+// Stores the traffic accounting of a container in <cdir>/meta/traffic.
+type TrafficTotals struct {
+
+	/* The cumulative traffic of the container. */
+	Total TrafficCounters;
+
+	/* The raw counters read at the last collection during the current
+	   run, which are subtracted from the next reading. */
+	Last TrafficCounters;
+
+	/* When the totals were last updated (seconds since the epoch). */
+	Updated int64;
+}
+
+// Returns counters that are all zero.
+func NewTrafficCounters() TrafficCounters {
+	return TrafficCounters{0, 0, 0, 0, make(map[string]uint64)}
+}
+
+// Returns the increase of a counter since its last reading. A reading
+// below the last one means the counter was reset (e.g. the veth pair was
+// recreated), in which case the whole reading is new traffic.
+func GetCounterIncrease(current uint64, last uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// Adds the increase of each counter since the last reading to the totals
+// and makes the current reading the last.
+func (this *TrafficTotals) Add(current TrafficCounters) {
+	this.Total.Rx_bytes += GetCounterIncrease(current.Rx_bytes, this.Last.Rx_bytes)
+	this.Total.Rx_packets += GetCounterIncrease(current.Rx_packets, this.Last.Rx_packets)
+	this.Total.Tx_bytes += GetCounterIncrease(current.Tx_bytes, this.Last.Tx_bytes)
+	this.Total.Tx_packets += GetCounterIncrease(current.Tx_packets, this.Last.Tx_packets)
+	for mapping, bytes := range current.Forwarded_bytes {
+		this.Total.Forwarded_bytes[mapping] += GetCounterIncrease(bytes, this.Last.Forwarded_bytes[mapping])
+	}
+	this.Last = current
+	this.Updated = time.Now().Unix()
+}
+
+// Reads a counter of a network interface from sysfs.
+func ReadInterfaceCounter(iface string, counter string) (uint64, error) {
+	counter_bytes, err := ioutil.ReadFile(path.Join("/sys/class/net", iface, "statistics", counter))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(counter_bytes)), 10, 64)
+}
+
+// Reads the counters of a host-side veth. The host end receives what the
+// container sends, so the directions are swapped.
+func ReadVethCounters(veth string, counters *TrafficCounters) error {
+	var err error
+	values := []*uint64{&counters.Tx_bytes, &counters.Tx_packets, &counters.Rx_bytes, &counters.Rx_packets}
+	for i, counter := range []string{"rx_bytes", "rx_packets", "tx_bytes", "tx_packets"} {
+		*values[i], err = ReadInterfaceCounter(veth, counter)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the byte counters of the host FORWARD rules installed for a
+// container’s port mappings, keyed by port mapping.
+//
+// @param cname The name of the container.
+// @param mappings The port mappings of the container.
+func ReadForwardedBytes(cname string, mappings []PortMapping) (map[string]uint64, error) {
+	result := make(map[string]uint64)
+	if len(mappings) == 0 {
+		return result, nil
+	}
+	out, err := exec.Command("iptables", "-t", "filter", "-L", "FORWARD", "-v", "-x", "-n").Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// pkts bytes target prot opt in out source destination ... /* COMMENT */
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		bytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		for _, mapping := range mappings {
+			if strings.Contains(line, "/* "+GetPortMappingComment(cname, mapping)+" */") {
+				result[mapping.String()] += bytes
+			}
+		}
+	}
+	return result, nil
+}
+
+// Returns the pathname of the container’s traffic accounting.
+func (this *Container) GetTrafficPathname() string {
+	return path.Join(this.meta_dir, "traffic")
+}
+
+// Reads the container’s traffic accounting. A container that has never
+// been accounted for has zero totals.
+func (this *Container) ReadTrafficTotals() (*TrafficTotals, error) {
+	totals := &TrafficTotals{NewTrafficCounters(), NewTrafficCounters(), 0}
+	traffic_bytes, err := ioutil.ReadFile(this.GetTrafficPathname())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return totals, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(traffic_bytes, totals)
+	if err != nil {
+		return nil, err
+	}
+	if totals.Total.Forwarded_bytes == nil {
+		totals.Total.Forwarded_bytes = make(map[string]uint64)
+	}
+	if totals.Last.Forwarded_bytes == nil {
+		totals.Last.Forwarded_bytes = make(map[string]uint64)
+	}
+	return totals, nil
+}
+
+// Reads and updates the container’s traffic accounting while holding its
+// lock.
+//
+// @param update Updates the totals in place.
+func (this *Container) UpdateTrafficTotals(update func(totals *TrafficTotals) error) (*TrafficTotals, error) {
+	lock, err := LockFile(this.GetTrafficPathname() + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	totals, err := this.ReadTrafficTotals()
+	if err != nil {
+		return nil, err
+	}
+	if err = update(totals); err != nil {
+		return nil, err
+	}
+	traffic_bytes, err := json.Marshal(totals)
+	if err != nil {
+		return nil, err
+	}
+	return totals, WriteFileAtomically(this.GetTrafficPathname(), traffic_bytes, 0644)
+}
+
+// Adds the traffic since the last collection to the container’s totals
+// and returns them. The totals are returned unchanged if the container is
+// not running.
+func (this *Container) CollectTraffic() (*TrafficTotals, error) {
+	if !this.IsRunning() {
+		return this.ReadTrafficTotals()
+	}
+	return this.UpdateTrafficTotals(func(totals *TrafficTotals) error {
+		current := NewTrafficCounters()
+		veth, err := this.GetPrimaryVethPair()
+		if err == nil {
+			if err = ReadVethCounters(veth, &current); err != nil {
+				return err
+			}
+		}
+		current.Forwarded_bytes, err = ReadForwardedBytes(this.name, this.Spec.Ports)
+		if err != nil {
+			return err
+		}
+		totals.Add(current)
+		return nil
+	})
+}
+
+// Forgets the raw counters of the last collection. Called when the
+// container starts or stops, since its counters then start again from
+// zero.
+func (this *Container) ResetTrafficBaseline() error {
+	_, err := this.UpdateTrafficTotals(func(totals *TrafficTotals) error {
+		totals.Last = NewTrafficCounters()
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,359 @@
+/// File: userns.go
+/// Purpose: Maps the uids and gids of unprivileged containers into ranges
+/// of the host’s subordinate ids and shifts the ownership of their files.
+/// Author: Damian Eads
+package quickbuddy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The number of uids and gids mapped into each container, enough for
+// every id an image set uses (including nobody, 65534).
+const USERNS_RANGE_SIZE int = 65536
+
+// Describes how a container’s uids and gids map to host ids. Container
+// id N is host id start+N for N below the count.
+type IdMap struct {
+
+	/* The host uid container uid 0 maps to. */
+	Uid_start int;
+
+	/* The host gid container gid 0 maps to. */
+	Gid_start int;
+
+	/* The number of ids mapped, or 0 if the container does not use a
+	   user namespace (its ids are the host’s). */
+	Count int;
+}
+
+// Describes a range of subordinate ids.
+type IdRange struct {
+	Start int;
+	Count int;
+}
+
+// Returns true iff the container uses a user namespace.
+func (this IdMap) IsEnabled() bool {
+	return this.Count > 0
+}
+
+// Returns true iff ranges of host ids have been allocated to the map. A
+// container created with a user namespace has none until it is
+// configured.
+func (this IdMap) IsAllocated() bool {
+	return this.IsEnabled() && (this.Uid_start != 0 || this.Gid_start != 0)
+}
+
+// Returns the host id of a container id given the start of its range.
+// Ids the map does not cover are returned unchanged.
+func (this IdMap) GetHostId(start int, id int) int {
+	if !this.IsEnabled() || id < 0 || id >= this.Count {
+		return id
+	}
+	return start + id
+}
+
+// Returns the host uid of a container uid.
+func (this IdMap) GetHostUid(uid int) int {
+	return this.GetHostId(this.Uid_start, uid)
+}
+
+// Returns the host gid of a container gid.
+func (this IdMap) GetHostGid(gid int) int {
+	return this.GetHostId(this.Gid_start, gid)
+}
+
+// Returns the container id of a host id given the start of its range,
+// and false if the map does not cover it. Without allocated ranges, host
+// ids are container ids.
+func (this IdMap) GetContainerId(start int, id int) (int, bool) {
+	if !this.IsAllocated() {
+		return id, true
+	}
+	if id < start || id >= start + this.Count {
+		return id, false
+	}
+	return id - start, true
+}
+
+// Returns the lxc.id_map entries of the map.
+func (this IdMap) GetLXCIdMap() []string {
+	return []string{
+		fmt.Sprintf("u 0 %d %d", this.Uid_start, this.Count),
+		fmt.Sprintf("g 0 %d %d", this.Gid_start, this.Count),
+	}
+}
+
+// Returns the map in the form shown by ’inspect’.
+func (this IdMap) String() string {
+	if !this.IsEnabled() {
+		return "none (privileged)"
+	} else if !this.IsAllocated() {
+		return "not allocated"
+	}
+	return fmt.Sprintf("uid 0-%d → %d-%d, gid 0-%d → %d-%d", this.Count - 1, this.Uid_start,
+		this.Uid_start + this.Count - 1, this.Count - 1, this.Gid_start, this.Gid_start + this.Count - 1)
+}
+
+// Reads the subordinate id ranges of a user from a file in the
+// user:start:count form of /etc/subuid. Entries may name the user or its
+// numeric uid.
+//
+// @param filename The subordinate id file (e.g. "/etc/subuid").
+// @param username The user whose ranges to read.
+func ReadSubordinateIds(filename string, username string) ([]IdRange, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{username: true}
+	if account, err := user.Lookup(username); err == nil {
+		names[account.Uid] = true
+	}
+	ranges := make([]IdRange, 0)
+	for line_no, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, errors.New(fmt.Sprintf("%s line %d: expected user:start:count", filename, line_no + 1))
+		}
+		if !names[fields[0]] {
+			continue
+		}
+		start, start_err := strconv.Atoi(fields[1])
+		count, count_err := strconv.Atoi(fields[2])
+		if start_err != nil || count_err != nil || start < 0 || count < 0 {
+			return nil, errors.New(fmt.Sprintf("%s line %d: invalid range ’%s’", filename, line_no + 1, line))
+		}
+		ranges = append(ranges, IdRange{start, count})
+	}
+	return ranges, nil
+}
+
+// Returns the start of the first range of USERNS_RANGE_SIZE ids within
+// the subordinate ranges that overlaps no used range.
+//
+// @param available The subordinate ranges.
+// @param used The ranges allocated to other containers.
+func FindFreeIdRange(available []IdRange, used []IdRange) (int, error) {
+	for _, subordinate := range available {
+		start := subordinate.Start
+		for start + USERNS_RANGE_SIZE <= subordinate.Start + subordinate.Count {
+			overlapping := false
+			for _, allocated := range used {
+				if start < allocated.Start + allocated.Count && allocated.Start < start + USERNS_RANGE_SIZE {
+					overlapping = true
+					// Skip past the allocated range.
+					start = allocated.Start + allocated.Count
+					break
+				}
+			}
+			if !overlapping {
+				return start, nil
+			}
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("no free range of %d subordinate ids", USERNS_RANGE_SIZE))
+}
+
+// Allocates ranges of the host’s subordinate uids and gids to the
+// container if it uses a user namespace. A range already held by another
+// container (e.g. one restored from a backup of a running container) is
+// replaced. The specification is saved before the lock is released.
+// Returns the map the container’s files are owned through before the
+// allocation.
+func (this *Container) AllocateIdMap() (IdMap, error) {
+	previous := this.Spec.Userns
+	if !previous.IsEnabled() {
+		return previous, nil
+	}
+	config, err := GetHostConfig()
+	if err != nil {
+		return previous, err
+	}
+	lock, err := LockFile(path.Join(this.GetContainersPath(), ".userns.lock"))
+	if err != nil {
+		return previous, err
+	}
+	defer lock.Close()
+	containers, err := ListContainers(this.GetContainersPath())
+	if err != nil {
+		return previous, err
+	}
+	used_uids, used_gids := make([]IdRange, 0), make([]IdRange, 0)
+	for _, container := range containers {
+		id_map := container.Spec.Userns
+		if container.name == this.name || !id_map.IsAllocated() {
+			continue
+		}
+		used_uids = append(used_uids, IdRange{id_map.Uid_start, id_map.Count})
+		used_gids = append(used_gids, IdRange{id_map.Gid_start, id_map.Count})
+	}
+	// Keep the current ranges if no other container holds them.
+	if previous.IsAllocated() && previous.Count == USERNS_RANGE_SIZE {
+		uid_start, uid_err := FindFreeIdRange([]IdRange{{previous.Uid_start, USERNS_RANGE_SIZE}}, used_uids)
+		gid_start, gid_err := FindFreeIdRange([]IdRange{{previous.Gid_start, USERNS_RANGE_SIZE}}, used_gids)
+		if uid_err == nil && gid_err == nil && uid_start == previous.Uid_start && gid_start == previous.Gid_start {
+			return previous, nil
+		}
+	}
+	subuids, err := ReadSubordinateIds(config.Subuid_file, config.Subid_user)
+	if err != nil {
+		return previous, err
+	}
+	subgids, err := ReadSubordinateIds(config.Subgid_file, config.Subid_user)
+	if err != nil {
+		return previous, err
+	}
+	id_map := IdMap{0, 0, USERNS_RANGE_SIZE}
+	if id_map.Uid_start, err = FindFreeIdRange(subuids, used_uids); err != nil {
+		return previous, errors.New(fmt.Sprintf("%s: %s", config.Subuid_file, err))
+	}
+	if id_map.Gid_start, err = FindFreeIdRange(subgids, used_gids); err != nil {
+		return previous, errors.New(fmt.Sprintf("%s: %s", config.Subgid_file, err))
+	}
+	this.Spec.Userns = id_map
+	if err = this.WriteSpec(); err != nil {
+		this.Spec.Userns = previous
+		return previous, err
+	}
+	return previous, nil
+}
+
+// Changes the ownership of every file in a directory from one id map to
+// another. Ids outside the old map (e.g. files qb wrote as host root)
+// are treated as container ids; ids the new map cannot hold are left
+// unchanged.
+//
+// @param dir The directory to shift (e.g. the container’s private data).
+// @param from The map the files are currently owned through.
+// @param to The map the files should be owned through.
+func ShiftOwnership(dir string, from IdMap, to IdMap) error {
+	return filepath.Walk(dir, func(pathname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		uid, _ := from.GetContainerId(from.Uid_start, int(stat.Uid))
+		gid, _ := from.GetContainerId(from.Gid_start, int(stat.Gid))
+		new_uid, new_gid := to.GetHostUid(uid), to.GetHostGid(gid)
+		if new_uid == int(stat.Uid) && new_gid == int(stat.Gid) {
+			return nil
+		}
+		// Lchown clears setuid and setgid bits, which are restored.
+		if err := os.Lchown(pathname, new_uid, new_gid); err != nil {
+			return err
+		}
+		if info.Mode() & (os.ModeSetuid | os.ModeSetgid) != 0 && info.Mode() & os.ModeSymlink == 0 {
+			return os.Chmod(pathname, info.Mode())
+		}
+		return nil
+	})
+}
+
+// Shifts the ownership of the container’s private data into its id map.
+// Files qb writes into the container from the host are owned by host
+// root until shifted. The image set is shared and is not shifted, so its
+// files appear to be owned by nobody until they are changed; the users’
+// home directories are changed (and so copied into the private data)
+// first so that the command servers can write to them.
+//
+// @param from The map the files are currently owned through.
+func (this *Container) ShiftPrivateData(from IdMap) error {
+	if !this.Spec.Userns.IsAllocated() {
+		return nil
+	}
+	if this.IsMounted() {
+		for _, user := range []string{"root", "web"} {
+			home_dir := path.Join(this.rootfs, this.GetHomeDirectory(user))
+			if !DirExists(home_dir) {
+				continue
+			}
+			uid, gid, _ := this.GetHostIds(user)
+			if err := os.Lchown(home_dir, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	return ShiftOwnership(this.private_dir, from, this.Spec.Userns)
+}
+
+// The files qb writes into a container from the host, relative to its
+// root filesystem.
+var HOST_WRITTEN_FILES = []string{"/etc/hostname", "/etc/hosts", "/etc/network/interfaces",
+	"/etc/dhcp/dhclient.conf", "/etc/dhcp3/dhclient.conf", "/root/iptables.conf", "/root/ip6tables.conf"}
+
+// Gives the container’s root the files qb writes into the container from
+// the host that are owned by host root, e.g. those created since the
+// private data was shifted. Unlike ShiftPrivateData, it does not walk the
+// private data, so it is cheap enough to run on every start.
+func (this *Container) ShiftWrittenFiles() error {
+	if !this.Spec.Userns.IsAllocated() {
+		return nil
+	}
+	uid, gid, _ := this.GetHostIds("root")
+	for _, filename := range HOST_WRITTEN_FILES {
+		pathname := path.Join(this.rootfs, filename)
+		info, err := os.Lstat(pathname)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || stat.Uid != 0 || stat.Gid != 0 {
+			continue
+		}
+		if err := os.Lchown(pathname, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the host uid and gid owning a user’s command FIFO in the
+// container, computed through the container’s id map.
+//
+// @param user The user ("root" or "web").
+func (this *Container) GetHostIds(user string) (int, int, error) {
+	uid, gid := 0, 0
+	switch user {
+	case "root":
+	case "web":
+		uid, gid = 1000, 1000
+	default:
+		return 0, 0, errors.New("users other than web or root are not supported.")
+	}
+	return this.Spec.Userns.GetHostUid(uid), this.Spec.Userns.GetHostGid(gid), nil
+}
+
+// Returns a copy of an LXC configuration with lxc.id_map set to the
+// container’s id map, if it uses a user namespace.
+func (this *Container) ApplyIdMap(info CgroupInfo) CgroupInfo {
+	result := make(CgroupInfo)
+	for key, values := range info {
+		if key != "lxc.id_map" {
+			result[key] = values
+		}
+	}
+	if this.Spec.Userns.IsAllocated() {
+		result["lxc.id_map"] = this.Spec.Userns.GetLXCIdMap()
+	}
+	return result
+}
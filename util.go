@@ -4,6 +4,7 @@ package quickbuddy
 /// file types.
 /// Author: Damian Eads
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -144,35 +145,70 @@ func WriteCommandServerConfigurationWithResourceLimits(user string, home_dir str
 	return cmd.Run()
 }
 
-// Configures IP tables for this root filesystem. (uses Brad’s config files)
+// Configures IP tables for this root filesystem using the default firewall
+// policy. Containers overwrite /root/iptables.conf and write
+// /root/ip6tables.conf with their own policy.
 //
 // @param rootfs The full pathname to a root filesystem for an OS.
 func ConfigureIPTables(rootfs string) error {
+	policy := NewDefaultFirewallPolicy()
 	err := ioutil.WriteFile(path.Join(rootfs, "/root/iptables.conf"),
-		[]byte(‘*filter
-			:INPUT ACCEPT [0:0]
-			:FORWARD ACCEPT [0:0]
-			:OUTPUT ACCEPT [0:0]
-			-A INPUT -p tcp -m tcp --dport 8080 -j ACCEPT
-			COMMIT
-			*nat
-			:PREROUTING ACCEPT [5:1083]
-			:INPUT ACCEPT [1:32]
-			:OUTPUT ACCEPT [0:0]
-			:POSTROUTING ACCEPT [0:0]
-			COMMIT
-			‘), 500)
+		GetIPTablesConfiguration(&policy, true), 500)
 	if err != nil {
 		return err
 	}
 	err = ioutil.WriteFile(path.Join(rootfs, "/etc/rc.local"),
 		[]byte(‘#!/bin/sh -e
 			/sbin/iptables-restore < /root/iptables.conf
+			[ -f /root/ip6tables.conf ] && /sbin/ip6tables-restore < /root/ip6tables.conf
 			exit 0
 			‘), 500)
 	return err
 }
 
+// Runs a host command (e.g. iptables) and returns an error that includes
+// its output if it fails.
+//
+// @param name The command to run.
+// @param args The command’s arguments.
+func RunCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s %s: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+// Opens (creating if necessary) and exclusively locks a file used to
+// serialize updates to host-wide state such as the address leases. The
+// lock is released by closing the returned file.
+//
+// @param filename The filename of the lock file.
+func LockFile(filename string) (*os.File, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Writes a file by writing a temporary file and renaming it so that
+// readers never see a partially written file.
+func WriteFileAtomically(filename string, data []byte, perm os.FileMode) error {
+	tmp_filename := filename + ".tmp"
+	err := ioutil.WriteFile(tmp_filename, data, perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp_filename, filename)
+}
+
 // Returns false iff a file exists and at least one byte can be read
 // from it without any I/O errors.
 //